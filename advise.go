@@ -0,0 +1,155 @@
+package eightsetmap
+
+import (
+	"encoding/binary"
+	"os"
+	"sort"
+
+	"github.com/tysontate/gommap"
+)
+
+// Advice is a hint to the operating system about how a mmap'd map will be
+// accessed, which controls how much of the file is read ahead.
+type Advice int
+
+const (
+	// AdviceNormal uses the default read ahead.
+	AdviceNormal Advice = iota
+
+	// AdviceRandom disables read ahead, for point lookups.
+	AdviceRandom
+
+	// AdviceSequential reads ahead aggressively, for scans with EachEntry.
+	AdviceSequential
+
+	// AdviceWillNeed starts reading the whole file into memory.
+	AdviceWillNeed
+)
+
+// flags returns the madvise flags for a.
+func (a Advice) flags() gommap.AdviseFlags {
+	switch a {
+	case AdviceRandom:
+		return gommap.MADV_RANDOM
+	case AdviceSequential:
+		return gommap.MADV_SEQUENTIAL
+	case AdviceWillNeed:
+		return gommap.MADV_WILLNEED
+	}
+	return gommap.MADV_NORMAL
+}
+
+// WithAdvice applies advice to the whole mapped file when a map is opened by
+// OpenMMap, and again whenever it is reloaded.
+func WithAdvice(advice Advice) Option {
+	return func(o *options) {
+		o.advice = advice
+	}
+}
+
+// byteRange is a range [start, end) of the mapped file.
+type byteRange struct {
+	start, end int64
+}
+
+// Prefetch starts reading the sets of values for the given keys into memory,
+// ahead of a batch of lookups or set operations. Missing keys are ignored, as
+// are keys in legacy files with unsorted lookup tables that cannot be searched.
+func (m *memMap) Prefetch(keys ...uint64) error {
+	s := m.acquire()
+	if s == nil {
+		return ErrClosed
+	}
+	defer s.release()
+
+	ranges := make([]byteRange, 0, len(keys))
+	for _, key := range keys {
+		offs, ok := s.offset(key)
+		if !ok {
+			continue
+		}
+		ranges = append(ranges, s.blockRange(offs))
+	}
+	return s.willNeed(ranges)
+}
+
+// Warm starts reading the sets of values for all keys where lo <= key <= hi
+// into memory, along with their lookup table entries.
+func (m *memMap) Warm(lo, hi uint64) error {
+	s := m.acquire()
+	if s == nil {
+		return ErrClosed
+	}
+	defer s.release()
+
+	var ranges []byteRange
+	first, last := int64(-1), int64(0)
+	i, err := s.table.search(lo)
+	if err != nil {
+		return err
+	}
+	for ; i < s.table.n; i++ {
+		k, offs := s.entry(i)
+		if k > hi {
+			break
+		}
+		if first < 0 {
+			first = s.table.start + int64(i)*16
+		}
+		last = s.table.start + int64(i+1)*16
+		if offs != 0 {
+			ranges = append(ranges, s.blockRange(offs))
+		}
+	}
+	if first >= 0 {
+		ranges = append(ranges, byteRange{first, last})
+	}
+	return s.willNeed(ranges)
+}
+
+// blockRange returns the range of the mapped file used by the block at offs.
+func (m *memState) blockRange(offs int64) byteRange {
+	if offs < 0 || offs+8 > int64(len(m.mmap)) {
+		return byteRange{}
+	}
+	c := int64(blockCap(binary.LittleEndian.Uint64(m.mmap[offs:])))
+	return byteRange{offs, offs + 8 + c*8}
+}
+
+// willNeed advises that the pages covering ranges will be needed soon. Ranges
+// which share pages are merged so that as few calls as possible are made.
+func (m *memState) willNeed(ranges []byteRange) error {
+	page := int64(os.Getpagesize())
+	size := int64(len(m.mmap))
+	for i := range ranges {
+		ranges[i].start &^= page - 1
+		if ranges[i].end > size {
+			ranges[i].end = size
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	var cur byteRange
+	for _, r := range ranges {
+		if r.start >= r.end {
+			continue
+		}
+		if cur.end > 0 && r.start <= cur.end {
+			if r.end > cur.end {
+				cur.end = r.end
+			}
+			continue
+		}
+		if cur.end > 0 {
+			err := m.mmap[cur.start:cur.end].Advise(gommap.MADV_WILLNEED)
+			if err != nil {
+				return err
+			}
+		}
+		cur = r
+	}
+	if cur.end > 0 {
+		return m.mmap[cur.start:cur.end].Advise(gommap.MADV_WILLNEED)
+	}
+	return nil
+}
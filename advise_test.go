@@ -0,0 +1,87 @@
+package eightsetmap
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAdvise(t *testing.T) {
+	os.Remove("advise_testing.8sm")
+	w, err := NewAppendWriter("advise_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to create writer", err)
+	}
+	for k := uint64(2); k < 20000; k += 2 {
+		vals := make([]uint64, k%40)
+		for i := range vals {
+			vals[i] = k + uint64(i)
+		}
+		err = w.Append(k, vals)
+		if err != nil {
+			t.Fatal("unable to append key", k, err)
+		}
+	}
+	m, err := w.Finish()
+	if err != nil {
+		t.Fatal("unable to finish writing", err)
+	}
+	m.Close()
+	defer os.Remove("advise_testing.8sm")
+	defer os.Remove(lockName("advise_testing.8sm"))
+
+	for _, advice := range []Advice{AdviceNormal, AdviceRandom, AdviceSequential, AdviceWillNeed} {
+		for _, lazy := range []bool{false, true} {
+			opts := []Option{WithAdvice(advice)}
+			if lazy {
+				opts = append(opts, WithLazyMMap())
+			}
+			mm, err := OpenMMap("advise_testing.8sm", opts...)
+			if err != nil {
+				t.Fatal("unable to mmap map", advice, err)
+			}
+			p, ok := mm.(Prefetcher)
+			if !ok {
+				t.Fatal("mmap'd map is not a Prefetcher")
+			}
+
+			// missing keys and keys past the end are ignored
+			err = p.Prefetch(4, 5, 18000, 1, 6, 8, 40000)
+			if err != nil {
+				t.Fatal("unable to prefetch keys", advice, lazy, err)
+			}
+			err = p.Prefetch()
+			if err != nil {
+				t.Fatal("unable to prefetch no keys", err)
+			}
+			for _, r := range [][2]uint64{{0, 100}, {5000, 9000}, {19990, 50000}, {30000, 40000}, {10, 5}} {
+				err = p.Warm(r[0], r[1])
+				if err != nil {
+					t.Fatal("unable to warm keys", r, advice, lazy, err)
+				}
+			}
+
+			if _, ok = mm.Get(5); ok {
+				t.Fatal("missing key found after prefetch")
+			}
+			for _, k := range []uint64{4, 18002} {
+				vals, ok := mm.Get(k)
+				if !ok || len(vals) != int(k%40) {
+					t.Fatal("unexpected values after prefetch", k, vals, ok)
+				}
+				for i, v := range vals {
+					if v != k+uint64(i) {
+						t.Fatal("unexpected values after prefetch", k, vals)
+					}
+				}
+			}
+
+			mm.Close()
+			if err = p.Prefetch(4); err != ErrClosed {
+				t.Fatal("prefetch on a closed map", err)
+			}
+			if err = p.Warm(0, 10); err != ErrClosed {
+				t.Fatal("warm on a closed map", err)
+			}
+		}
+	}
+}
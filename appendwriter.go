@@ -0,0 +1,134 @@
+package eightsetmap
+
+import (
+	"fmt"
+	"os"
+)
+
+// AppendWriter creates a new map file from keys given in ascending order,
+// each with its sorted set of values. Sets are written directly to the
+// data section and the lookup table is spilled to a temporary file, so only
+// the current set needs to be kept in memory.
+type AppendWriter struct {
+	filename string
+	opts     []Option
+
+	f  *os.File
+	h  *Header
+	sw *setWriter
+
+	lastkey  uint64
+	nwritten uint64
+}
+
+// NewAppendWriter prepares to write a new map in filename, replacing any
+// existing file when Finish is called. The options are used to open the
+// finished map.
+func NewAppendWriter(filename string, opts ...Option) (*AppendWriter, error) {
+	f, err := createTemp(filename, "")
+	if err != nil {
+		return nil, err
+	}
+	w := &AppendWriter{
+		filename: filename,
+		opts:     opts,
+		f:        f,
+		h:        &Header{},
+	}
+	w.sw, err = newTrailingSetWriter(f, w.h, DefaultPacker)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// SetPacker sets the packer used to reserve space or custom data for each key,
+// see CommitWithPacker. The default is DefaultPacker. It must be called
+// before the first Append.
+func (w *AppendWriter) SetPacker(packer PackerFunc) {
+	w.sw.packer = packer
+}
+
+// SetCompression enables or disables delta + varint encoded value sets (see
+// FlagDeltaVarint). It must be called before the first Append.
+func (w *AppendWriter) SetCompression(enabled bool) {
+	if enabled {
+		w.h.Flags |= FlagDeltaVarint
+	} else {
+		w.h.Flags &^= FlagDeltaVarint
+	}
+}
+
+// SetBitmaps enables or disables bitmap containers for dense value sets (see
+// FlagBitmaps). It must be called before the first Append.
+func (w *AppendWriter) SetBitmaps(enabled bool) {
+	if enabled {
+		w.h.Flags |= FlagBitmaps
+	} else {
+		w.h.Flags &^= FlagBitmaps
+	}
+}
+
+// Append writes the set of values for key. Keys must be appended in strictly
+// ascending order, and the values must be sorted and unique, otherwise an
+// error wrapping ErrUnsorted is returned and nothing is written.
+func (w *AppendWriter) Append(key uint64, sortedVals []uint64) error {
+	if w.sw == nil {
+		return ErrClosed
+	}
+	if w.nwritten > 0 && key <= w.lastkey {
+		return fmt.Errorf("eightsetmap: %s: key %d appended after %d: %w", w.filename, key, w.lastkey, ErrUnsorted)
+	}
+	for i := 1; i < len(sortedVals); i++ {
+		if sortedVals[i] <= sortedVals[i-1] {
+			return fmt.Errorf("eightsetmap: %s: key %d has value %d after %d: %w", w.filename, key, sortedVals[i], sortedVals[i-1], ErrUnsorted)
+		}
+	}
+
+	_, err := w.sw.add(key, sortedVals)
+	if err != nil {
+		return err
+	}
+	w.lastkey = key
+	w.nwritten++
+	return nil
+}
+
+// Finish writes the lookup table, moves the new file into place and opens it.
+func (w *AppendWriter) Finish() (Map, error) {
+	if w.sw == nil {
+		return nil, ErrClosed
+	}
+	defer w.Abort()
+
+	l, err := lockExclusive(w.filename)
+	if err != nil {
+		return nil, err
+	}
+	// continue the generation of the file being replaced
+	if h, err := ReadHeader(w.filename); err == nil {
+		w.h.Generation = h.Generation + 1
+	} else {
+		w.h.Generation = 1
+	}
+	err = w.sw.finish()
+	if err == nil {
+		err = replaceFile(w.f, w.filename)
+	}
+	l.unlock()
+	if err != nil {
+		return nil, err
+	}
+	return Open(w.filename, w.opts...)
+}
+
+// Abort discards the new file and any temporary files.
+func (w *AppendWriter) Abort() {
+	if w.sw != nil {
+		w.sw.close()
+		w.sw = nil
+	}
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
@@ -0,0 +1,113 @@
+package eightsetmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// keyPacker stores the key and the size of its set as custom data.
+func keyPacker(key uint64, valsize uint32) (int, interface{}) {
+	return 2, []uint64{key, uint64(valsize)}
+}
+
+func TestAppendWriter(t *testing.T) {
+	os.Remove("append_testing.8sm")
+	os.Remove("append_testing2.8sm")
+	os.Remove(lockName("append_testing.8sm"))
+	os.Remove(lockName("append_testing2.8sm"))
+
+	// the same sets through a MutableMap for comparison
+	mm := Mutate(New("append_testing2.8sm"), false)
+	w, err := NewAppendWriter("append_testing.8sm", WithShift(3))
+	if err != nil {
+		t.Fatal("unable to create writer", err)
+	}
+	w.SetPacker(keyPacker)
+	for k := uint64(10); k < 1000; k += 10 {
+		vals := make([]uint64, k/10)
+		for i := range vals {
+			vals[i] = uint64(i) * 3
+		}
+		err = w.Append(k, vals)
+		if err != nil {
+			t.Fatal("unable to append key", k, err)
+		}
+		mk := mm.OpenKey(k)
+		mk.PutSlice(vals)
+		mk.Sync()
+	}
+
+	err = w.Append(500, []uint64{1})
+	if !errors.Is(err, ErrUnsorted) {
+		t.Fatal("expected ErrUnsorted for an out-of-order key, got", err)
+	}
+	err = w.Append(2000, []uint64{2, 1})
+	if !errors.Is(err, ErrUnsorted) {
+		t.Fatal("expected ErrUnsorted for unsorted values, got", err)
+	}
+	err = w.Append(2000, nil)
+	if err != nil {
+		t.Fatal("unable to append key after an error", err)
+	}
+	mm.OpenKey(2000).Sync()
+
+	m, err := w.Finish()
+	if err != nil {
+		t.Fatal("unable to finish writing", err)
+	}
+	defer m.Close()
+	err = mm.CommitWithPacker(keyPacker)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	temps, _ := filepath.Glob("append_testing.8sm?*")
+	if len(temps) != 1 || temps[0] != lockName("append_testing.8sm") {
+		t.Fatal("temporary files left behind", temps)
+	}
+	if err = w.Append(3000, nil); err != ErrClosed {
+		t.Fatal("expected ErrClosed after Finish, got", err)
+	}
+
+	for _, x := range []Map{m, mm.Map} {
+		for k := uint64(10); k <= 2000; k += 10 {
+			var extra []uint64
+			vals, ok := x.GetWithExtra(k, func(n int, r io.Reader) {
+				extra = make([]uint64, n)
+				binary.Read(r, binary.LittleEndian, extra)
+			})
+			if k >= 1000 && k != 2000 {
+				if ok {
+					t.Fatal("found unexpected key", k)
+				}
+				continue
+			}
+			if !ok {
+				t.Fatal("did not find key", k)
+			}
+			if uint64(len(vals)) != k/10 && k != 2000 {
+				t.Fatal("key", k, "has", len(vals), "values")
+			}
+			if len(extra) != 2 || extra[0] != k || extra[1] != uint64(len(vals)) {
+				t.Fatal("key", k, "has unexpected extra data", extra)
+			}
+		}
+	}
+
+	r, err := Verify("append_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to verify written file", err, r.Problems)
+	}
+	if r.Keys != 100 {
+		t.Fatal("verified", r.Keys, "keys instead of 100")
+	}
+
+	os.Remove("append_testing.8sm")
+	os.Remove("append_testing2.8sm")
+	os.Remove(lockName("append_testing.8sm"))
+	os.Remove(lockName("append_testing2.8sm"))
+}
@@ -0,0 +1,177 @@
+package eightsetmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// FlagBitmaps is a required feature flag for files where dense sets of values
+// may be stored as bitmap containers instead of sorted arrays. The container
+// is chosen per key at commit time, whichever takes less space.
+//
+// A bitmap container is marked by the top bit of the capacity, and holds the
+// base value, the number of bitmap words, then the bitmap words themselves.
+const FlagBitmaps uint64 = 1 << 1
+
+// bitmapBlock marks a set stored as a bitmap container in its caplen.
+const bitmapBlock uint64 = 1 << 63
+
+// blockCap returns the capacity in 8-byte words from caplen.
+func blockCap(caplen uint64) uint32 {
+	return uint32((caplen &^ bitmapBlock) >> 32)
+}
+
+// Bitmap is a dense set of values, where value Base+64*i+j is in the set when
+// bit j of Bits[i] is set. Base is always a multiple of 64.
+type Bitmap struct {
+	Base uint64
+	Bits []uint64
+}
+
+// newBitmap builds a Bitmap from a sorted set of values.
+func newBitmap(vals []uint64) Bitmap {
+	if len(vals) == 0 {
+		return Bitmap{}
+	}
+	base := vals[0] &^ 63
+	b := Bitmap{Base: base, Bits: make([]uint64, (vals[len(vals)-1]-base)/64+1)}
+	for _, v := range vals {
+		b.Bits[(v-base)/64] |= 1 << ((v - base) % 64)
+	}
+	return b
+}
+
+// Len returns the number of values in the set.
+func (b Bitmap) Len() int {
+	n := 0
+	for _, w := range b.Bits {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// Contains returns true if v is in the set.
+func (b Bitmap) Contains(v uint64) bool {
+	if v < b.Base {
+		return false
+	}
+	i := (v - b.Base) / 64
+	return i < uint64(len(b.Bits)) && b.Bits[i]&(1<<((v-b.Base)%64)) != 0
+}
+
+// Values appends the sorted values in the set to vals.
+func (b Bitmap) Values(vals []uint64) []uint64 {
+	for i, w := range b.Bits {
+		for w != 0 {
+			j := bits.TrailingZeros64(w)
+			vals = append(vals, b.Base+uint64(i)*64+uint64(j))
+			w &= w - 1
+		}
+	}
+	return vals
+}
+
+// And returns the intersection of two bitmaps.
+func (b Bitmap) And(o Bitmap) Bitmap {
+	if o.Base > b.Base {
+		b, o = o, b
+	}
+	// b starts at or after o
+	skip := (b.Base - o.Base) / 64
+	if skip >= uint64(len(o.Bits)) {
+		return Bitmap{}
+	}
+	n := len(b.Bits)
+	if rest := len(o.Bits) - int(skip); rest < n {
+		n = rest
+	}
+	r := Bitmap{Base: b.Base, Bits: make([]uint64, n)}
+	for i := range r.Bits {
+		r.Bits[i] = b.Bits[i] & o.Bits[int(skip)+i]
+	}
+	return r
+}
+
+// Or returns the union of two bitmaps.
+func (b Bitmap) Or(o Bitmap) Bitmap {
+	if len(b.Bits) == 0 {
+		return o
+	}
+	if len(o.Bits) == 0 {
+		return b
+	}
+	base := b.Base
+	if o.Base < base {
+		base = o.Base
+	}
+	r := Bitmap{Base: base, Bits: make([]uint64, b.span(o))}
+	for _, x := range []Bitmap{b, o} {
+		skip := (x.Base - base) / 64
+		for i, w := range x.Bits {
+			r.Bits[skip+uint64(i)] |= w
+		}
+	}
+	return r
+}
+
+// span returns the number of words needed for a bitmap covering both b and o.
+// The range is computed in words, since the end of a bitmap at the top of the
+// uint64 range does not fit in a value.
+func (b Bitmap) span(o Bitmap) uint64 {
+	lo, hi := b.Base/64, b.Base/64+uint64(len(b.Bits))
+	if o.Base/64 < lo {
+		lo = o.Base / 64
+	}
+	if e := o.Base/64 + uint64(len(o.Bits)); e > hi {
+		hi = e
+	}
+	return hi - lo
+}
+
+// appendSet appends the smallest encoding of vals allowed by the flags to
+// buf, and returns true if a bitmap container was used.
+func appendSet(buf []byte, vals []uint64, flags uint64) ([]byte, bool) {
+	start := len(buf)
+	buf = appendValues(buf, vals, flags)
+	if flags&FlagBitmaps == 0 || len(vals) == 0 {
+		return buf, false
+	}
+
+	nwords := (vals[len(vals)-1]-vals[0]&^63)/64 + 1
+	if 8*(2+nwords) >= uint64(len(buf)-start) {
+		return buf, false
+	}
+
+	b := newBitmap(vals)
+	buf = buf[:start]
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], b.Base)
+	buf = append(buf, tmp[:]...)
+	binary.LittleEndian.PutUint64(tmp[:], uint64(len(b.Bits)))
+	buf = append(buf, tmp[:]...)
+	for _, w := range b.Bits {
+		binary.LittleEndian.PutUint64(tmp[:], w)
+		buf = append(buf, tmp[:]...)
+	}
+	return buf, true
+}
+
+// decodeBitmap decodes a bitmap container from b, and returns it along with
+// the number of bytes used.
+func decodeBitmap(b []byte) (Bitmap, int, error) {
+	if len(b) < 16 {
+		return Bitmap{}, 0, fmt.Errorf("truncated bitmap: %w", ErrCorrupt)
+	}
+	base := binary.LittleEndian.Uint64(b)
+	n := binary.LittleEndian.Uint64(b[8:])
+	if base%64 != 0 || n > uint64(len(b)-16)/8 || n > math.MaxUint64/64-base/64+1 {
+		return Bitmap{}, 0, fmt.Errorf("invalid bitmap: %w", ErrCorrupt)
+	}
+	bm := Bitmap{Base: base, Bits: make([]uint64, n)}
+	for i := range bm.Bits {
+		bm.Bits[i] = binary.LittleEndian.Uint64(b[16+i*8:])
+	}
+	return bm, 16 + 8*int(n), nil
+}
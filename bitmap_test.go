@@ -0,0 +1,173 @@
+package eightsetmap
+
+import (
+	"math"
+	"os"
+	"testing"
+)
+
+func TestBitmap(t *testing.T) {
+	a := newBitmap([]uint64{3, 64, 65, 200, 1000})
+	b := newBitmap([]uint64{65, 66, 1000, 5000})
+	if a.Base != 0 || b.Base != 64 {
+		t.Fatal("unexpected bases", a.Base, b.Base)
+	}
+	if a.Len() != 5 || !a.Contains(200) || a.Contains(201) || b.Contains(3) {
+		t.Fatal("unexpected bitmap contents", a.Values(nil))
+	}
+
+	chk := func(msg string, rs, ex []uint64) {
+		if len(rs) != len(ex) {
+			t.Fatalf("%s. got %v, expected %v", msg, rs, ex)
+		}
+		for i, x := range rs {
+			if x != ex[i] {
+				t.Fatalf("%s. got %v, expected %v", msg, rs, ex)
+			}
+		}
+	}
+	chk("and", a.And(b).Values(nil), []uint64{65, 1000})
+	chk("and reversed", b.And(a).Values(nil), []uint64{65, 1000})
+	chk("or", a.Or(b).Values(nil), []uint64{3, 64, 65, 66, 200, 1000, 5000})
+	chk("or empty", Bitmap{}.Or(b).Values(nil), []uint64{65, 66, 1000, 5000})
+	chk("disjoint and", a.And(newBitmap([]uint64{1 << 40})).Values(nil), nil)
+}
+
+func TestBitmapSets(t *testing.T) {
+	os.Remove("bitmap_testing.8sm")
+	want := make(map[uint64][]uint64)
+	m := New("bitmap_testing.8sm")
+	mm := Mutate(m, false)
+	mm.SetBitmaps(true)
+	for k := uint64(1); k <= 6; k++ {
+		mk := mm.OpenKey(k)
+		// dense runs of multiples of k, overlapping between keys
+		for i := uint64(0); i < 5000; i++ {
+			if i%k == 0 {
+				mk.Put(1000*k + i)
+				want[k] = append(want[k], 1000*k+i)
+			}
+		}
+		mk.Sync()
+	}
+	// a sparse set stays a sorted array
+	mk := mm.OpenKey(10)
+	for i := uint64(0); i < 100; i++ {
+		mk.Put(i * 997)
+		want[10] = append(want[10], i*997)
+	}
+	mk.Sync()
+	err := mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	for _, x := range []Map{m, MMap(New("bitmap_testing.8sm"))} {
+		checkCompressed(t, x, want)
+
+		bm := x.(BitmapMap)
+		for k := uint64(1); k <= 6; k++ {
+			if _, ok := bm.GetBitmap(k); !ok {
+				t.Fatal("dense key", k, "not stored as a bitmap")
+			}
+		}
+		if _, ok := bm.GetBitmap(10); ok {
+			t.Fatal("sparse key stored as a bitmap")
+		}
+
+		// compare against the merge-based set operations
+		chk := func(msg string, rs, ex []uint64) {
+			if len(rs) != len(ex) {
+				t.Fatalf("%s. size mismatch got %d, expected %d", msg, len(rs), len(ex))
+			}
+			for i, v := range rs {
+				if v != ex[i] {
+					t.Fatalf("%s. got result[%d]=%d, expected %d", msg, i, v, ex[i])
+				}
+			}
+		}
+		chk("union", Union(x, 1, 2), subUnion(want[1], want[2]))
+		chk("intersect", Intersect(x, 2, 3), subIntersect(want[2], want[3]))
+		chk("multi-union", MultiUnion(x, 1, 3, 5, 10),
+			subUnion(subUnion(want[1], want[3]), subUnion(want[5], want[10])))
+		chk("multi-intersect", MultiIntersect(x, 2, 3, 4),
+			subIntersect(subIntersect(want[2], want[3]), want[4]))
+		chk("mixed multi-intersect", MultiIntersect(x, 1, 3, 10),
+			subIntersect(subIntersect(want[1], want[3]), want[10]))
+		chk("missing multi-intersect", MultiIntersect(x, 1, 3, 99), nil)
+	}
+
+	// in-place updates can switch between containers
+	mm = Mutate(New("bitmap_testing.8sm"), false)
+	mk = mm.OpenKey(1)
+	var sparse []uint64
+	for i, v := range want[1] {
+		if i%500 == 0 {
+			sparse = append(sparse, v)
+		} else {
+			mk.Remove(v)
+		}
+	}
+	mk.Sync()
+	want[1] = sparse
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	checkCompressed(t, mm.Map, want)
+	if _, ok := mm.Map.GetBitmap(1); ok {
+		t.Fatal("sparse set still stored as a bitmap")
+	}
+
+	r, err := Verify("bitmap_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to verify bitmap file", err, r.Problems)
+	}
+
+	os.Remove("bitmap_testing.8sm")
+	os.Remove(lockName("bitmap_testing.8sm"))
+}
+
+func TestBitmapTopOfRange(t *testing.T) {
+	a := newBitmap([]uint64{math.MaxUint64 - 1, math.MaxUint64})
+	b := newBitmap([]uint64{math.MaxUint64 - 100})
+	if vals := a.Or(b).Values(nil); len(vals) != 3 || vals[2] != math.MaxUint64 {
+		t.Fatal("unexpected or at the top of the range", vals)
+	}
+
+	os.Remove("bitmap_top_testing.8sm")
+	defer os.Remove("bitmap_top_testing.8sm")
+	defer os.Remove(lockName("bitmap_top_testing.8sm"))
+	want := make(map[uint64][]uint64)
+	m := New("bitmap_top_testing.8sm")
+	mm := Mutate(m, false)
+	mm.SetBitmaps(true)
+	for k, r := range map[uint64][2]uint64{
+		1: {math.MaxUint64 - 200, math.MaxUint64},
+		2: {math.MaxUint64 - 1000, math.MaxUint64 - 801},
+	} {
+		mk := mm.OpenKey(k)
+		for v := r[0]; ; v++ {
+			mk.Put(v)
+			want[k] = append(want[k], v)
+			if v == r[1] {
+				break
+			}
+		}
+		mk.Sync()
+	}
+	err := mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	if _, ok := m.(BitmapMap).GetBitmap(1); !ok {
+		t.Fatal("dense key not stored as a bitmap")
+	}
+	ex := subUnion(want[1], want[2])
+	for _, rs := range [][]uint64{Union(m, 1, 2), MultiUnion(m, 1, 2)} {
+		if len(rs) != len(ex) || rs[0] != ex[0] || rs[len(rs)-1] != math.MaxUint64 {
+			t.Fatal("unexpected union at the top of the range", len(rs), len(ex))
+		}
+	}
+	m.Close()
+}
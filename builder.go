@@ -0,0 +1,304 @@
+package eightsetmap
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+)
+
+var (
+	// BuildBufferSize is the number of bytes of (key, value) pairs a Builder
+	// keeps in memory before spilling them to a sorted run file.
+	BuildBufferSize = 64 << 20
+
+	// BuildMaxRuns is the number of run files a Builder keeps before merging
+	// them into a single run, to bound the number of open files.
+	BuildMaxRuns = 128
+)
+
+// Builder creates a new map file from (key, value) pairs added in any order,
+// using a bounded amount of memory. Pairs are buffered and spilled to sorted
+// run files next to the output file, which are merged, de-duplicated and
+// written to the final file in one streaming pass by Finish.
+//
+// Only the values of a single key need to fit in memory at once. The lookup
+// table is always written in sorted key order, so the result can be opened
+// with any shift.
+type Builder struct {
+	filename string
+	opts     []Option
+	packer   PackerFunc
+	flags    uint64
+
+	buf   [][2]uint64
+	limit int
+	runs  []*os.File
+}
+
+// NewBuilder prepares to build a new map in filename, replacing any existing
+// file when Finish is called. The options are used to open the finished map.
+func NewBuilder(filename string, opts ...Option) *Builder {
+	return &Builder{
+		filename: filename,
+		opts:     opts,
+		packer:   DefaultPacker,
+		limit:    BuildBufferSize / 16,
+	}
+}
+
+// SetPacker sets the packer used to reserve space or custom data for each key,
+// see CommitWithPacker. The default is DefaultPacker.
+func (b *Builder) SetPacker(packer PackerFunc) {
+	b.packer = packer
+}
+
+// SetCompression enables or disables delta + varint encoded value sets (see
+// FlagDeltaVarint).
+func (b *Builder) SetCompression(enabled bool) {
+	if enabled {
+		b.flags |= FlagDeltaVarint
+	} else {
+		b.flags &^= FlagDeltaVarint
+	}
+}
+
+// SetBitmaps enables or disables bitmap containers for dense value sets (see
+// FlagBitmaps).
+func (b *Builder) SetBitmaps(enabled bool) {
+	if enabled {
+		b.flags |= FlagBitmaps
+	} else {
+		b.flags &^= FlagBitmaps
+	}
+}
+
+// Add adds val to the set of values for key.
+func (b *Builder) Add(key, val uint64) error {
+	b.buf = append(b.buf, [2]uint64{key, val})
+	if len(b.buf) < b.limit {
+		return nil
+	}
+	return b.spill()
+}
+
+// AddSlice adds all of vals to the set of values for key.
+func (b *Builder) AddSlice(key uint64, vals []uint64) error {
+	for _, v := range vals {
+		err := b.Add(key, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finish merges all of the added pairs into the output file, removes any
+// temporary files, and opens the new map.
+func (b *Builder) Finish() (Map, error) {
+	defer b.Abort()
+	sortPairs(b.buf)
+
+	w, err := NewAppendWriter(b.filename, b.opts...)
+	if err != nil {
+		return nil, err
+	}
+	w.SetPacker(b.packer)
+	w.SetCompression(b.flags&FlagDeltaVarint != 0)
+	w.SetBitmaps(b.flags&FlagBitmaps != 0)
+
+	var key uint64
+	var vals []uint64
+	err = b.merge(func(k, v uint64) error {
+		if len(vals) > 0 && k != key {
+			err := w.Append(key, vals)
+			if err != nil {
+				return err
+			}
+			vals = vals[:0]
+		}
+		key = k
+		vals = append(vals, v)
+		return nil
+	})
+	if err == nil && len(vals) > 0 {
+		err = w.Append(key, vals)
+	}
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w.Finish()
+}
+
+// Abort discards all of the added pairs and removes any temporary files.
+func (b *Builder) Abort() {
+	for _, rf := range b.runs {
+		rf.Close()
+		os.Remove(rf.Name())
+	}
+	b.runs = nil
+	b.buf = b.buf[:0]
+}
+
+// spill writes the buffered pairs to a new sorted run file.
+func (b *Builder) spill() error {
+	if len(b.runs) >= BuildMaxRuns {
+		// merge the existing runs (and the buffer) into one
+		sortPairs(b.buf)
+		rf, err := b.writeRun(b.merge)
+		if err != nil {
+			return err
+		}
+		b.Abort()
+		b.runs = []*os.File{rf}
+		return nil
+	}
+
+	sortPairs(b.buf)
+	buf := b.buf
+	rf, err := b.writeRun(func(emit func(k, v uint64) error) error {
+		return mergeRuns([]*pairRun{{mem: buf}}, emit)
+	})
+	if err != nil {
+		return err
+	}
+	b.runs = append(b.runs, rf)
+	b.buf = b.buf[:0]
+	return nil
+}
+
+// writeRun writes the pairs produced by each to a new run file.
+func (b *Builder) writeRun(each func(func(k, v uint64) error) error) (*os.File, error) {
+	rf, err := createTemp(b.filename, "run")
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriterSize(rf, 1<<20)
+	var pair [16]byte
+	err = each(func(k, v uint64) error {
+		binary.LittleEndian.PutUint64(pair[:], k)
+		binary.LittleEndian.PutUint64(pair[8:], v)
+		_, err := w.Write(pair[:])
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		rf.Close()
+		os.Remove(rf.Name())
+		return nil, err
+	}
+	return rf, nil
+}
+
+// merge calls emit for every unique pair in the run files and the (sorted)
+// buffer, in sorted order.
+func (b *Builder) merge(emit func(k, v uint64) error) error {
+	runs := make([]*pairRun, 0, len(b.runs)+1)
+	for _, rf := range b.runs {
+		r := bufio.NewReaderSize(io.NewSectionReader(rf, 0, 1<<62), 1<<16)
+		runs = append(runs, &pairRun{r: r})
+	}
+	runs = append(runs, &pairRun{mem: b.buf})
+	return mergeRuns(runs, emit)
+}
+
+func sortPairs(pairs [][2]uint64) {
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+}
+
+// mergeRuns does a k-way merge of sorted runs, calling emit for every unique pair.
+func mergeRuns(runs []*pairRun, emit func(k, v uint64) error) error {
+	h := make(runHeap, 0, len(runs))
+	for _, r := range runs {
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, r)
+		}
+	}
+	heap.Init(&h)
+
+	var last [2]uint64
+	first := true
+	for len(h) > 0 {
+		r := h[0]
+		if first || r.cur != last {
+			err := emit(r.cur[0], r.cur[1])
+			if err != nil {
+				return err
+			}
+			first = false
+			last = r.cur
+		}
+
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	return nil
+}
+
+// pairRun is a sorted run of (key, value) pairs, either from a run file or in memory.
+type pairRun struct {
+	r   *bufio.Reader
+	mem [][2]uint64
+	cur [2]uint64
+}
+
+// next advances to the next pair in the run, returning false at the end.
+func (r *pairRun) next() (bool, error) {
+	if r.r == nil {
+		if len(r.mem) == 0 {
+			return false, nil
+		}
+		r.cur, r.mem = r.mem[0], r.mem[1:]
+		return true, nil
+	}
+
+	var pair [16]byte
+	_, err := io.ReadFull(r.r, pair[:])
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	r.cur[0] = binary.LittleEndian.Uint64(pair[:])
+	r.cur[1] = binary.LittleEndian.Uint64(pair[8:])
+	return true, nil
+}
+
+// runHeap is a min-heap of runs ordered by their current pair.
+type runHeap []*pairRun
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	a, b := h[i].cur, h[j].cur
+	return a[0] < b[0] || (a[0] == b[0] && a[1] < b[1])
+}
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*pairRun)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,115 @@
+package eightsetmap
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	defer func(size, runs int) {
+		BuildBufferSize, BuildMaxRuns = size, runs
+	}(BuildBufferSize, BuildMaxRuns)
+	// force lots of spilled runs, and merging them
+	BuildBufferSize, BuildMaxRuns = 16*1000, 4
+
+	os.Remove("builder_testing.8sm")
+	want := make(map[uint64]map[uint64]struct{})
+	b := NewBuilder("builder_testing.8sm", WithShift(2))
+	b.SetPacker(TightPacker)
+	b.SetCompression(true)
+	rng := rand.New(rand.NewSource(42))
+	for i := 0; i < 20000; i++ {
+		k := uint64(rng.Intn(500)) * 7
+		v := uint64(rng.Intn(100))
+		if want[k] == nil {
+			want[k] = make(map[uint64]struct{})
+		}
+		want[k][v] = struct{}{}
+		err := b.Add(k, v)
+		if err != nil {
+			t.Fatal("unable to add pair", err)
+		}
+	}
+	m, err := b.Finish()
+	if err != nil {
+		t.Fatal("unable to build map", err)
+	}
+	defer m.Close()
+
+	temps, _ := filepath.Glob("builder_testing.8sm?*")
+	if len(temps) != 1 || temps[0] != lockName("builder_testing.8sm") {
+		t.Fatal("temporary files left behind", temps)
+	}
+
+	check := func(m Map) {
+		n := 0
+		err := m.EachEntry(func(k uint64, vals []uint64) error {
+			n++
+			if len(vals) != len(want[k]) {
+				t.Fatal("key", k, "has", len(vals), "values instead of", len(want[k]))
+			}
+			for i, v := range vals {
+				if _, ok := want[k][v]; !ok || (i > 0 && vals[i-1] >= v) {
+					t.Fatal("key", k, "has unexpected or unsorted value", v)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal("unable to walk entries", err)
+		}
+		if n != len(want) {
+			t.Fatal("walked", n, "entries instead of", len(want))
+		}
+		for k := range want {
+			vals, ok := m.Get(k)
+			if !ok || len(vals) != len(want[k]) {
+				t.Fatal("unable to get key", k)
+			}
+		}
+	}
+	check(m)
+	check(New("builder_testing.8sm"))
+
+	r, err := Verify("builder_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to verify built file", err, r.Problems)
+	}
+	if r.Header.Flags != FlagDeltaVarint|FlagChecksums|FlagGeneration {
+		t.Fatalf("unexpected header flags %#x", r.Header.Flags)
+	}
+
+	// built maps can be updated as usual
+	mm := Mutate(New("builder_testing.8sm"), false)
+	mk := mm.OpenKey(1)
+	mk.Put(1)
+	mk.Sync()
+	want[1] = map[uint64]struct{}{1: {}}
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	check(New("builder_testing.8sm"))
+
+	os.Remove("builder_testing.8sm")
+	os.Remove(lockName("builder_testing.8sm"))
+}
+
+func TestBuilderEmpty(t *testing.T) {
+	os.Remove("builder_testing.8sm")
+	b := NewBuilder("builder_testing.8sm")
+	b.AddSlice(5, []uint64{3, 1, 2})
+	b.Abort()
+	m, err := b.Finish()
+	if err != nil {
+		t.Fatal("unable to build map", err)
+	}
+	if _, ok := m.Get(5); ok {
+		t.Fatal("aborted builder wrote a key")
+	}
+	m.Close()
+	os.Remove("builder_testing.8sm")
+	os.Remove(lockName("builder_testing.8sm"))
+}
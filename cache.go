@@ -0,0 +1,317 @@
+package eightsetmap
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/hashicorp/golang-lru"
+)
+
+// Cache holds recently read sets of values for a map opened by Open. A new
+// cache is created for each generation of the file that is loaded, see
+// WithCache. Implementations must be safe for concurrent use, and must not
+// modify the cached slices.
+type Cache interface {
+	// Get returns the cached set of values for key.
+	Get(key uint64) ([]uint64, bool)
+
+	// Add caches the set of values for key, replacing any cached set.
+	Add(key uint64, vals []uint64)
+
+	// Remove drops key from the cache.
+	Remove(key uint64)
+
+	// Purge drops all keys from the cache.
+	Purge()
+
+	// Len returns the number of keys in the cache.
+	Len() int
+
+	// Stats returns the cache counters.
+	Stats() CacheStats
+}
+
+// CacheStats counts the work done by a Cache.
+type CacheStats struct {
+	Hits      uint64 // calls to Get which found the key
+	Misses    uint64 // calls to Get which did not find the key
+	Evictions uint64 // keys dropped to make room for other keys
+
+	Len   int   // number of keys cached
+	Bytes int64 // weight of the cached sets, for caches limited by size
+}
+
+// add accumulates the counters in o. Len and Bytes are left as they are, since
+// they describe the current contents of a cache rather than past work.
+func (st *CacheStats) add(o CacheStats) {
+	st.Hits += o.Hits
+	st.Misses += o.Misses
+	st.Evictions += o.Evictions
+}
+
+// WithCache sets the function used to create the cache for each generation of
+// the file loaded by Open. The default is a LRU cache limited to both
+// DefaultCacheSize keys and DefaultCacheBytes of values.
+func WithCache(newCache func() Cache) Option {
+	return func(o *options) {
+		o.cache = newCache
+	}
+}
+
+// newCache returns an empty cache for the sets of values read from a file.
+func newCache(o *options) Cache {
+	if o.cache != nil {
+		return o.cache()
+	}
+	c := NewSizedCache(DefaultCacheBytes).(*sizedCache)
+	c.maxKeys = DefaultCacheSize
+	return c
+}
+
+// Stats returns the counters of the map's cache. The counters continue across
+// reloads and commits, while Len and Bytes describe the current generation.
+// Snapshots share the cache of their generation, and only count from when the
+// snapshot was taken.
+func (m *stdMap) Stats() CacheStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	st := m.stats
+	if !m.closed {
+		cur := m.state.cache.Stats()
+		cur.add(st)
+		st = cur
+	}
+	return st
+}
+
+////////
+//
+// size limited LRU cache
+//
+////////
+
+// sizedCache is a LRU cache limited by the total weight of the cached sets.
+type sizedCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	maxKeys  int        // or 0 for no limit
+	ll       *list.List // of *sizedEntry, most recently used first
+	items    map[uint64]*list.Element
+	stats    CacheStats
+}
+
+type sizedEntry struct {
+	key  uint64
+	vals []uint64
+}
+
+// NewSizedCache returns a LRU Cache which holds sets of values up to a total
+// of maxBytes, where each set weighs 8 bytes per value. Empty sets weigh as
+// much as one value, and sets larger than maxBytes are not cached.
+func NewSizedCache(maxBytes int64) Cache {
+	return &sizedCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[uint64]*list.Element),
+	}
+}
+
+// cacheWeight returns the number of bytes vals counts for in a sizedCache.
+func cacheWeight(vals []uint64) int64 {
+	if len(vals) == 0 {
+		return 8
+	}
+	return int64(len(vals)) * 8
+}
+
+func (c *sizedCache) Get(key uint64) ([]uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.ll.MoveToFront(e)
+	return e.Value.(*sizedEntry).vals, true
+}
+
+func (c *sizedCache) Add(key uint64, vals []uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := cacheWeight(vals)
+	if w > c.maxBytes {
+		c.remove(key)
+		return
+	}
+	if e, ok := c.items[key]; ok {
+		ent := e.Value.(*sizedEntry)
+		c.stats.Bytes += w - cacheWeight(ent.vals)
+		ent.vals = vals
+		c.ll.MoveToFront(e)
+	} else {
+		c.items[key] = c.ll.PushFront(&sizedEntry{key: key, vals: vals})
+		c.stats.Bytes += w
+	}
+	for c.stats.Bytes > c.maxBytes || (c.maxKeys > 0 && len(c.items) > c.maxKeys) {
+		ent := c.ll.Back().Value.(*sizedEntry)
+		c.remove(ent.key)
+		c.stats.Evictions++
+	}
+}
+
+func (c *sizedCache) Remove(key uint64) {
+	c.mu.Lock()
+	c.remove(key)
+	c.mu.Unlock()
+}
+
+// remove drops key from the cache, c.mu must be held.
+func (c *sizedCache) remove(key uint64) {
+	e, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.stats.Bytes -= cacheWeight(e.Value.(*sizedEntry).vals)
+	c.ll.Remove(e)
+	delete(c.items, key)
+}
+
+func (c *sizedCache) Purge() {
+	c.mu.Lock()
+	c.ll.Init()
+	c.items = make(map[uint64]*list.Element)
+	c.stats.Bytes = 0
+	c.mu.Unlock()
+}
+
+func (c *sizedCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+func (c *sizedCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.stats
+	st.Len = len(c.items)
+	return st
+}
+
+////////
+//
+// caches limited by count, from golang-lru
+//
+////////
+
+// keyCache is the method set shared by the golang-lru caches.
+type keyCache interface {
+	Get(key interface{}) (interface{}, bool)
+	Add(key, value interface{})
+	Contains(key interface{}) bool
+	Remove(key interface{})
+	Purge()
+	Len() int
+}
+
+// lruCache adapts lru.Cache to keyCache.
+type lruCache struct {
+	*lru.Cache
+}
+
+func (c lruCache) Add(key, value interface{}) { c.Cache.Add(key, value) }
+func (c lruCache) Remove(key interface{})     { c.Cache.Remove(key) }
+
+// countedCache adds counters to a golang-lru cache.
+type countedCache struct {
+	mu    sync.Mutex
+	c     keyCache
+	stats CacheStats
+}
+
+// NewLRUCache returns a Cache which holds up to size sets of values, evicting
+// the least recently used. If size <= 0 then DefaultCacheSize is used.
+func NewLRUCache(size int) Cache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	c, _ := lru.New(size) // err always nil
+	return &countedCache{c: lruCache{c}}
+}
+
+// New2QCache returns a Cache which holds up to size sets of values, tracking
+// recently and frequently used keys separately so that a scan over many keys
+// does not evict the keys that are used often. If size <= 0 then
+// DefaultCacheSize is used.
+func New2QCache(size int) Cache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	c, _ := lru.New2Q(size) // err always nil
+	return &countedCache{c: c}
+}
+
+// NewARCCache returns an adaptive replacement Cache which holds up to size
+// sets of values, balancing between recently and frequently used keys. If
+// size <= 0 then DefaultCacheSize is used.
+func NewARCCache(size int) Cache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	c, _ := lru.NewARC(size) // err always nil
+	return &countedCache{c: c}
+}
+
+func (c *countedCache) Get(key uint64) ([]uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	val, ok := c.c.Get(key)
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	return val.([]uint64), true
+}
+
+func (c *countedCache) Add(key uint64, vals []uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.c.Contains(key) {
+		c.c.Add(key, vals)
+		return
+	}
+	n := c.c.Len()
+	c.c.Add(key, vals)
+	if after := c.c.Len(); after <= n {
+		c.stats.Evictions += uint64(n + 1 - after)
+	}
+}
+
+func (c *countedCache) Remove(key uint64) {
+	c.mu.Lock()
+	c.c.Remove(key)
+	c.mu.Unlock()
+}
+
+func (c *countedCache) Purge() {
+	c.mu.Lock()
+	c.c.Purge()
+	c.mu.Unlock()
+}
+
+func (c *countedCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.c.Len()
+}
+
+func (c *countedCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.stats
+	st.Len = c.c.Len()
+	return st
+}
@@ -0,0 +1,146 @@
+package eightsetmap
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSizedCache(t *testing.T) {
+	c := NewSizedCache(100)
+	c.Add(1, make([]uint64, 5)) // 40 bytes
+	c.Add(2, make([]uint64, 5))
+	c.Add(3, nil) // weighs 8 bytes
+	if st := c.Stats(); st.Len != 3 || st.Bytes != 88 || st.Evictions != 0 {
+		t.Fatal("unexpected stats", st)
+	}
+
+	// touch 1 so that 2 is evicted first
+	if _, ok := c.Get(1); !ok {
+		t.Fatal("key 1 not cached")
+	}
+	c.Add(4, make([]uint64, 3))
+	if _, ok := c.Get(2); ok {
+		t.Fatal("key 2 should have been evicted")
+	}
+	if _, ok := c.Get(1); !ok {
+		t.Fatal("key 1 evicted before key 2")
+	}
+
+	// too large to cache, and replaces the smaller cached set
+	c.Add(1, make([]uint64, 20))
+	if _, ok := c.Get(1); ok {
+		t.Fatal("set larger than the cache was cached")
+	}
+
+	// replacing a set updates its weight
+	c.Add(3, make([]uint64, 2))
+	c.Remove(4)
+	st := c.Stats()
+	if st.Len != 1 || st.Bytes != 16 || st.Hits != 2 || st.Misses != 2 || st.Evictions != 1 {
+		t.Fatal("unexpected stats", st)
+	}
+	c.Purge()
+	if st = c.Stats(); st.Len != 0 || st.Bytes != 0 || c.Len() != 0 {
+		t.Fatal("cache not purged", st)
+	}
+}
+
+func TestCountedCaches(t *testing.T) {
+	for name, newCache := range map[string]func(int) Cache{
+		"lru": NewLRUCache,
+		"2q":  New2QCache,
+		"arc": NewARCCache,
+	} {
+		c := newCache(10)
+		for k := uint64(0); k < 25; k++ {
+			c.Add(k, []uint64{k})
+			c.Add(k, []uint64{k, k + 1})
+		}
+		st := c.Stats()
+		if st.Len != 10 || st.Evictions != 15 {
+			t.Fatal(name, "unexpected stats", st)
+		}
+		vals, ok := c.Get(24)
+		if !ok || len(vals) != 2 || vals[1] != 25 {
+			t.Fatal(name, "unexpected cached values", vals, ok)
+		}
+		if _, ok = c.Get(0); ok {
+			t.Fatal(name, "key 0 should have been evicted")
+		}
+		c.Remove(24)
+		if st = c.Stats(); st.Len != 9 || st.Hits != 1 || st.Misses != 1 {
+			t.Fatal(name, "unexpected stats", st)
+		}
+		c.Purge()
+		if c.Len() != 0 {
+			t.Fatal(name, "cache not purged")
+		}
+	}
+}
+
+func TestMapCacheStats(t *testing.T) {
+	os.Remove("cache_testing.8sm")
+	defer os.Remove("cache_testing.8sm")
+	defer os.Remove(lockName("cache_testing.8sm"))
+	m := New("cache_testing.8sm")
+	mm := Mutate(m, false)
+	for k := uint64(1); k <= 20; k++ {
+		mk := mm.OpenKey(k)
+		mk.Put(k)
+		mk.Sync()
+	}
+	err := mm.Commit(true)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	m.Close()
+
+	m, err = Open("cache_testing.8sm", WithCache(func() Cache { return NewLRUCache(4) }))
+	if err != nil {
+		t.Fatal("unable to open map", err)
+	}
+	cm, ok := m.(CachedMap)
+	if !ok {
+		t.Fatal("map opened by Open is not a CachedMap")
+	}
+	for k := uint64(1); k <= 6; k++ {
+		m.Get(k)
+	}
+	m.Get(6)
+	st := cm.Stats()
+	if st.Len != 4 || st.Hits != 1 || st.Misses != 6 || st.Evictions != 2 {
+		t.Fatal("unexpected stats", st)
+	}
+
+	// the counters continue after a reload
+	err = m.Reload()
+	if err != nil {
+		t.Fatal("unable to reload map", err)
+	}
+	m.Get(6)
+	st = cm.Stats()
+	if st.Len != 1 || st.Hits != 1 || st.Misses != 7 || st.Evictions != 2 {
+		t.Fatal("unexpected stats after reload", st)
+	}
+
+	m.Close()
+	if st = cm.Stats(); st.Len != 0 || st.Misses != 7 {
+		t.Fatal("unexpected stats after close", st)
+	}
+
+	// the default cache is limited by DefaultCacheSize as well
+	defer func(size int) { DefaultCacheSize = size }(DefaultCacheSize)
+	DefaultCacheSize = 3
+	m, err = Open("cache_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to open map", err)
+	}
+	defer m.Close()
+	for k := uint64(1); k <= 5; k++ {
+		m.Get(k)
+	}
+	st = m.(CachedMap).Stats()
+	if st.Len != 3 || st.Evictions != 2 || st.Bytes != 24 {
+		t.Fatal("unexpected stats for the default cache", st)
+	}
+}
@@ -0,0 +1,140 @@
+package eightsetmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+////////
+//
+// Files with FlagChecksums have a checksum section directly after the lookup
+// table:
+//
+// [num_keys]uint32 CRC32C of each value set (caplen and all capacity bytes)
+// padding to an 8-byte boundary
+// uint32 CRC32C of the lookup table
+// uint32 CRC32C of the header (including custom data)
+//
+////////
+
+// FlagChecksums is an optional feature flag for files that contain CRC32C
+// checksums, see Verify.
+const FlagChecksums uint64 = 1 << 32
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumSize returns the size of the checksum section for n keys.
+func checksumSize(n uint64) int64 {
+	return align8(int64(n)*4) + 8
+}
+
+// align8 rounds n up to a multiple of 8.
+func align8(n int64) int64 {
+	return (n + 7) &^ 7
+}
+
+// blockChecksum computes the checksum of the value set at offs.
+func blockChecksum(r io.ReaderAt, offs int64) (uint32, error) {
+	caplen, err := readCaplen(r, offs)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 8+8*int64(blockCap(caplen)))
+	_, err = r.ReadAt(buf, offs)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(buf, castagnoli), nil
+}
+
+// tableChecksum computes the checksum of n lookup table entries at start.
+func tableChecksum(r io.ReaderAt, start int64, n uint64) (uint32, error) {
+	h := crc32.New(castagnoli)
+	sr := io.NewSectionReader(r, start, int64(n)*16)
+	_, err := io.Copy(h, bufio.NewReaderSize(sr, 1<<16))
+	if err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// readChecksum reads the uint32 checksum at offs.
+func readChecksum(r io.ReaderAt, offs int64) (uint32, error) {
+	var buf [4]byte
+	_, err := r.ReadAt(buf[:], offs)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(buf[:]), nil
+}
+
+// writeChecksum writes the uint32 checksum at offs.
+func writeChecksum(w io.WriterAt, offs int64, sum uint32) error {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], sum)
+	_, err := w.WriteAt(buf[:], offs)
+	return err
+}
+
+// validBlock checks that the value set described by caplen at offs fits
+// within a file of the given size, so that corrupted data cannot cause huge
+// allocations. Compressed sets use at least one byte per value, and bitmap
+// containers at least one bit.
+func validBlock(size, offs int64, caplen, flags uint64) bool {
+	c, l := int64(blockCap(caplen)), int64(uint32(caplen))
+	if caplen&bitmapBlock != 0 {
+		return flags&FlagBitmaps != 0 && offs > 0 && l <= c*64 && offs+8+c*8 <= size
+	}
+	if flags&FlagDeltaVarint != 0 {
+		return offs > 0 && l <= c*8 && offs+8+c*8 <= size
+	}
+	return offs > 0 && l <= c && offs+8+c*8 <= size
+}
+
+// updateChecksums recomputes the checksums for the value sets at the given
+// offsets, and for the lookup table and header if they were modified, after
+// an in-place commit.
+func (s *stdState) updateChecksums(f readerWriterAt, offsets map[uint64]int64, tableChanged, headerChanged bool) error {
+	t := tableReader{r: f, start: int64(s.start), n: s.nkeys}
+	sumStart := t.start + int64(t.n)*16
+	for key, offs := range offsets {
+		i, err := t.search(key)
+		if err != nil {
+			return err
+		}
+		if k, _, err := t.entry(i); err != nil || k != key {
+			return fmt.Errorf("eightsetmap: key %d not found in lookup table", key)
+		}
+		sum, err := blockChecksum(f, offs)
+		if err != nil {
+			return err
+		}
+		err = writeChecksum(f, sumStart+int64(i)*4, sum)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tableChanged {
+		sum, err := tableChecksum(f, t.start, t.n)
+		if err != nil {
+			return err
+		}
+		err = writeChecksum(f, sumStart+align8(int64(t.n)*4), sum)
+		if err != nil {
+			return err
+		}
+	}
+	if headerChanged {
+		hdr := make([]byte, headerSize+len(s.data))
+		_, err := f.ReadAt(hdr, 0)
+		if err != nil {
+			return err
+		}
+		return writeChecksum(f, sumStart+align8(int64(t.n)*4)+4, crc32.Checksum(hdr, castagnoli))
+	}
+	return nil
+}
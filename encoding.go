@@ -0,0 +1,83 @@
+package eightsetmap
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// FlagDeltaVarint is a required feature flag for files where each set of
+// values is stored as uvarint-encoded deltas between the sorted values
+// (padded to an 8-byte boundary), instead of as raw little-endian uint64s.
+// The capacity of a set then counts reserved 8-byte words rather than values.
+const FlagDeltaVarint uint64 = 1 << 0
+
+// appendValues appends the encoding of vals used by a file with the given
+// flags to buf.
+func appendValues(buf []byte, vals []uint64, flags uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	if flags&FlagDeltaVarint == 0 {
+		for _, v := range vals {
+			binary.LittleEndian.PutUint64(tmp[:], v)
+			buf = append(buf, tmp[:8]...)
+		}
+		return buf
+	}
+
+	start := len(buf)
+	var last uint64
+	for _, v := range vals {
+		n := binary.PutUvarint(tmp[:], v-last)
+		buf = append(buf, tmp[:n]...)
+		last = v
+	}
+	for (len(buf)-start)%8 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// decodeValues decodes the set of values described by caplen from b (reusing
+// the storage in vals), and returns them along with the number of bytes used
+// (always a multiple of 8).
+func decodeValues(vals []uint64, b []byte, caplen uint64, flags uint64) ([]uint64, int, error) {
+	l := uint32(caplen)
+	if caplen&bitmapBlock != 0 {
+		bm, n, err := decodeBitmap(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		vals = bm.Values(vals[:0])
+		if len(vals) != int(l) {
+			return nil, 0, fmt.Errorf("bitmap has %d values instead of %d: %w", len(vals), l, ErrCorrupt)
+		}
+		return vals, n, nil
+	}
+
+	if cap(vals) < int(l) {
+		vals = make([]uint64, l)
+	}
+	vals = vals[:l]
+
+	if flags&FlagDeltaVarint == 0 {
+		if len(b) < 8*int(l) {
+			return nil, 0, ErrCorrupt
+		}
+		for i := range vals {
+			vals[i] = binary.LittleEndian.Uint64(b[i*8:])
+		}
+		return vals, 8 * int(l), nil
+	}
+
+	pos := 0
+	var last uint64
+	for i := range vals {
+		d, n := binary.Uvarint(b[pos:])
+		if n <= 0 {
+			return nil, 0, fmt.Errorf("invalid varint in value set: %w", ErrCorrupt)
+		}
+		pos += n
+		last += d
+		vals[i] = last
+	}
+	return vals, int(align8(int64(pos))), nil
+}
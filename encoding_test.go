@@ -0,0 +1,141 @@
+package eightsetmap
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func checkCompressed(t *testing.T, x Map, want map[uint64][]uint64) {
+	for k, vals := range want {
+		got, found := x.Get(k)
+		if !found {
+			t.Fatal("did not find key", k)
+		}
+		if len(got) != len(vals) {
+			t.Fatal("key", k, "has", len(got), "values instead of", len(vals))
+		}
+		for i, v := range vals {
+			if got[i] != v {
+				t.Fatalf("key %d value[%d]=%d, expected %d", k, i, got[i], v)
+			}
+		}
+		n, _ := x.GetSize(k)
+		if int(n) != len(vals) {
+			t.Fatal("key", k, "has size", n, "instead of", len(vals))
+		}
+	}
+
+	n := 0
+	err := x.EachEntry(func(k uint64, vals []uint64) error {
+		n++
+		if len(vals) != len(want[k]) {
+			return fmt.Errorf("key %d has %d values", k, len(vals))
+		}
+		for i, v := range vals {
+			if v != want[k][i] {
+				return fmt.Errorf("key %d value[%d]=%d, expected %d", k, i, v, want[k][i])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("unable to walk entries", err)
+	}
+	if n != len(want) {
+		t.Fatal("walked", n, "entries instead of", len(want))
+	}
+}
+
+func TestCompression(t *testing.T) {
+	os.Remove("compress_testing.8sm")
+	want := make(map[uint64][]uint64)
+	m := New("compress_testing.8sm")
+	mm := Mutate(m, false)
+	mm.SetCompression(true)
+	for k := uint64(1); k <= 100; k++ {
+		mk := mm.OpenKey(k)
+		for i := uint64(0); i < k*10; i++ {
+			mk.Put(i * k)
+			want[k] = append(want[k], i*k)
+		}
+		mk.Sync()
+	}
+	err := mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	h, err := ReadHeader("compress_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to read header", err)
+	}
+	if h.Flags&FlagDeltaVarint == 0 {
+		t.Fatal("compression flag not set in header")
+	}
+	// small deltas take a single byte per value
+	if c, _ := m.GetCapacity(100); c >= 500 {
+		t.Fatal("compressed capacity", c, "is not smaller than the set")
+	}
+
+	checkCompressed(t, m, want)
+	checkCompressed(t, NewShifted("compress_testing.8sm", 3), want)
+	checkCompressed(t, MMap(New("compress_testing.8sm")), want)
+
+	if n := len(Intersect(m, 2, 3)); n != 7 {
+		t.Fatal("intersection has", n, "values instead of 7")
+	}
+
+	// keep the existing encoding when re-opened
+	mm = Mutate(New("compress_testing.8sm"), false)
+	mk := mm.OpenKey(100)
+	mk.Put(1)
+	mk.Sync()
+	want[100] = append([]uint64{0, 1}, want[100][1:]...)
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	checkCompressed(t, mm.Map, want)
+
+	// large deltas do not fit in the reserved bytes, forcing a rewrite
+	before, _ := mm.Map.GetCapacity(50)
+	mk = mm.OpenKey(50)
+	for i := uint64(1); i <= 30; i++ {
+		mk.Put(i << 58)
+		want[50] = append(want[50], i<<58)
+	}
+	mk.Sync()
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	if c, _ := mm.Map.GetCapacity(50); c <= before {
+		t.Fatal("expected a full rewrite for an overflowing compressed set")
+	}
+	checkCompressed(t, New("compress_testing.8sm"), want)
+
+	r, err := Verify("compress_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to verify compressed file", err, r.Problems)
+	}
+
+	// turning compression off rewrites the file with raw sets
+	mm = Mutate(New("compress_testing.8sm"), true)
+	mm.SetCompression(false)
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	h, err = ReadHeader("compress_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to read header", err)
+	}
+	if h.Flags&FlagDeltaVarint != 0 {
+		t.Fatal("compression flag still set in header")
+	}
+	checkCompressed(t, New("compress_testing.8sm"), want)
+
+	os.Remove("compress_testing.8sm")
+	os.Remove(lockName("compress_testing.8sm"))
+}
@@ -0,0 +1,176 @@
+package eightsetmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+////////
+//
+// Versioned header (FormatVersion 2 and later):
+//
+// uint32 MAGIC2
+// uint32 version
+// uint64 feature flags (low 32 bits required, high 32 bits optional)
+// uint64 lookup table offset
+// uint64 num_keys
+// uint64 generation (see FlagGeneration)
+// uint32 custom data length
+// uint32 reserved
+// [custom data length]byte
+//
+// Legacy header (FormatVersion 1):
+//
+// uint32 MAGIC
+// uint32 custom data length
+// [custom data length]byte
+// uint64 num_keys
+//
+// In both versions the lookup table and value sets follow the header as
+// described in main.go.
+//
+////////
+
+const (
+	// MAGIC2 header uint32 = 'j8s2' defines the versioned file type.
+	MAGIC2 uint32 = 0x3273386a
+
+	// FormatVersion is the version of the on-disk format written by this package.
+	FormatVersion uint32 = 2
+
+	// FlagsRequired is the mask of feature flags that a reader must understand
+	// to use the file. Files with unknown required flags are rejected with
+	// ErrUnsupported, while unknown optional flags (the upper 32 bits) are ignored.
+	FlagsRequired uint64 = 0xffffffff
+
+	// size of the fixed part of the versioned header
+	headerSize = 48
+
+	// offset of the generation counter in the versioned header
+	generationOffset = 32
+)
+
+// knownFlags contains all feature flags understood by this package.
+var knownFlags = FlagChecksums | FlagDeltaVarint | FlagBitmaps | FlagGeneration
+
+// Header describes the file-level metadata of an 8sm file.
+type Header struct {
+	// Version is the format version, 1 for legacy files.
+	Version uint32
+
+	// Flags contains the feature flags in use by the file.
+	Flags uint64
+
+	// NumKeys is the number of entries in the lookup table.
+	NumKeys uint64
+
+	// TableOffset is the file offset of the first lookup table entry.
+	TableOffset int64
+
+	// Generation is incremented by every commit to the file.
+	Generation uint64
+
+	// Data contains the custom data embedded within the file.
+	Data []byte
+}
+
+// ReadHeader reads the header from filename, so that the version and features
+// in use can be checked without loading the map.
+func ReadHeader(filename string) (*Header, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("eightsetmap: %s: %w", filename, ErrNotExist)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	h, err := readHeader(f)
+	if err != nil {
+		return nil, loadError(filename, err)
+	}
+	return h, nil
+}
+
+// readHeader reads either a legacy or a versioned header from r, leaving r
+// positioned just after it.
+func readHeader(r io.Reader) (*Header, error) {
+	var buf [headerSize]byte
+	_, err := io.ReadFull(r, buf[:4])
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Header{}
+	var dlen uint32
+	switch binary.LittleEndian.Uint32(buf[:4]) {
+	case MAGIC:
+		h.Version = 1
+		_, err = io.ReadFull(r, buf[4:8])
+		if err != nil {
+			return nil, err
+		}
+		dlen = binary.LittleEndian.Uint32(buf[4:8])
+
+	case MAGIC2:
+		_, err = io.ReadFull(r, buf[4:])
+		if err != nil {
+			return nil, err
+		}
+		h.Version = binary.LittleEndian.Uint32(buf[4:])
+		h.Flags = binary.LittleEndian.Uint64(buf[8:])
+		h.TableOffset = int64(binary.LittleEndian.Uint64(buf[16:]))
+		h.NumKeys = binary.LittleEndian.Uint64(buf[24:])
+		h.Generation = binary.LittleEndian.Uint64(buf[generationOffset:])
+		dlen = binary.LittleEndian.Uint32(buf[40:])
+
+		if h.Version < 2 || h.Version > FormatVersion {
+			return nil, fmt.Errorf("%w: format version %d", ErrUnsupported, h.Version)
+		}
+		if unk := h.Flags & FlagsRequired &^ knownFlags; unk != 0 {
+			return nil, fmt.Errorf("%w: required feature flags %#x", ErrUnsupported, unk)
+		}
+
+	default:
+		return nil, ErrBadMagic
+	}
+
+	if dlen > 0 {
+		h.Data = make([]byte, dlen)
+		_, err = io.ReadFull(r, h.Data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if h.Version == 1 {
+		_, err = io.ReadFull(r, buf[:8])
+		if err != nil {
+			return nil, err
+		}
+		h.NumKeys = binary.LittleEndian.Uint64(buf[:8])
+		h.TableOffset = int64(16 + dlen)
+	}
+	return h, nil
+}
+
+// size returns the number of bytes used by the versioned header.
+func (h *Header) size() int64 {
+	return headerSize + int64(len(h.Data))
+}
+
+// encode returns the versioned header bytes.
+func (h *Header) encode() []byte {
+	buf := make([]byte, headerSize, h.size())
+	binary.LittleEndian.PutUint32(buf[0:], MAGIC2)
+	binary.LittleEndian.PutUint32(buf[4:], FormatVersion)
+	binary.LittleEndian.PutUint64(buf[8:], h.Flags)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(h.TableOffset))
+	binary.LittleEndian.PutUint64(buf[24:], h.NumKeys)
+	binary.LittleEndian.PutUint64(buf[generationOffset:], h.Generation)
+	// overflow is possible, but if it happens WTF
+	binary.LittleEndian.PutUint32(buf[40:], uint32(len(h.Data)))
+	return append(buf, h.Data...)
+}
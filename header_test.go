@@ -0,0 +1,228 @@
+package eightsetmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// writeLegacy writes a FormatVersion 1 file with a single value per key.
+func writeLegacy(t *testing.T, filename string, data []byte, keys []uint64) {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, MAGIC)
+	binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	binary.Write(buf, binary.LittleEndian, uint64(len(keys)))
+	offs := int64(buf.Len() + 16*len(keys))
+	for _, k := range keys {
+		binary.Write(buf, binary.LittleEndian, k)
+		binary.Write(buf, binary.LittleEndian, offs)
+		offs += 16
+	}
+	for _, k := range keys {
+		binary.Write(buf, binary.LittleEndian, uint64(1)<<32|1)
+		binary.Write(buf, binary.LittleEndian, k*2)
+	}
+	err := ioutil.WriteFile(filename, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyHeader(t *testing.T) {
+	os.Remove("legacy_testing.8sm")
+	writeLegacy(t, "legacy_testing.8sm", []byte("legacy"), []uint64{1, 2, 3})
+
+	h, err := ReadHeader("legacy_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to read legacy header", err)
+	}
+	if h.Version != 1 || h.NumKeys != 3 || string(h.Data) != "legacy" {
+		t.Fatalf("unexpected legacy header %+v", h)
+	}
+
+	m := New("legacy_testing.8sm")
+	for _, x := range []Map{m, NewShifted("legacy_testing.8sm", 1), MMap(m)} {
+		for _, k := range []uint64{1, 2, 3} {
+			vals, ok := x.Get(k)
+			if !ok || len(vals) != 1 || vals[0] != k*2 {
+				t.Fatalf("key %d has values %v in legacy file", k, vals)
+			}
+		}
+	}
+
+	// committing upgrades the file to the current version
+	mm := Mutate(m, false)
+	mk := mm.OpenKey(4)
+	mk.Put(8)
+	mk.Sync()
+	err = mm.Commit(true)
+	if err != nil {
+		t.Fatal("unable to commit to legacy file", err)
+	}
+	h, err = ReadHeader("legacy_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to read upgraded header", err)
+	}
+	if h.Version != FormatVersion || h.NumKeys != 4 || string(h.Data) != "legacy" {
+		t.Fatalf("unexpected upgraded header %+v", h)
+	}
+	m = New("legacy_testing.8sm")
+	for _, k := range []uint64{1, 2, 3, 4} {
+		vals, ok := m.Get(k)
+		if !ok || len(vals) != 1 || vals[0] != k*2 {
+			t.Fatalf("key %d has values %v in upgraded file", k, vals)
+		}
+	}
+
+	// deletes upgrade the file instead of leaving tombstones in a legacy table
+	writeLegacy(t, "legacy_testing.8sm", nil, []uint64{1, 2, 3})
+	mm = Mutate(New("legacy_testing.8sm"), false)
+	mm.DeleteKey(2)
+	res, err := mm.CommitWithResult(false)
+	if err != nil {
+		t.Fatal("unable to delete from legacy file", err)
+	}
+	if res.InPlace {
+		t.Fatal("legacy file deleted from in-place")
+	}
+	h, err = ReadHeader("legacy_testing.8sm")
+	if err != nil || h.Version != FormatVersion || h.NumKeys != 2 {
+		t.Fatalf("unexpected header after delete %+v %v", h, err)
+	}
+	if _, ok := New("legacy_testing.8sm").Get(2); ok {
+		t.Fatal("deleted key found in upgraded file")
+	}
+
+	os.Remove("legacy_testing.8sm")
+	os.Remove(lockName("legacy_testing.8sm"))
+}
+
+func TestLegacyUnsorted(t *testing.T) {
+	os.Remove("unsorted_testing.8sm")
+	defer os.Remove("unsorted_testing.8sm")
+	defer os.Remove(lockName("unsorted_testing.8sm"))
+	writeLegacy(t, "unsorted_testing.8sm", nil, []uint64{5, 3, 9, 1})
+
+	m := New("unsorted_testing.8sm")
+	defer m.Close()
+	mm, err := OpenMMap("unsorted_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to mmap legacy map", err)
+	}
+	defer mm.Close()
+	for _, x := range []Map{m, mm} {
+		var keys []uint64
+		collect := func(k uint64) error {
+			keys = append(keys, k)
+			return nil
+		}
+		check := func(msg string, expected ...uint64) {
+			if !equalValues(keys, expected) {
+				t.Fatal(msg, "walked keys", keys, "instead of", expected)
+			}
+			keys = nil
+		}
+		x.EachKeySorted(collect)
+		check("sorted:", 1, 3, 5, 9)
+		x.EachKeyReverse(collect)
+		check("reverse:", 9, 5, 3, 1)
+		x.EachKeyInRange(2, 5, collect)
+		check("range:", 3, 5)
+		x.EachKeyInRange(6, 100, collect)
+		check("range:", 9)
+		x.EachKeyInRange(5, 2, collect)
+		check("empty range:")
+	}
+
+	// committing sorts the table, so the file can then be opened shifted
+	mut := Mutate(m, false)
+	mk := mut.OpenKey(4)
+	mk.Put(8)
+	mk.Sync()
+	mut.DeleteKey(9)
+	err = mut.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit to unsorted legacy file", err)
+	}
+	sm, err := Open("unsorted_testing.8sm", WithShift(1))
+	if err != nil {
+		t.Fatal("unable to open committed file shifted", err)
+	}
+	defer sm.Close()
+	var keys []uint64
+	sm.EachKeySorted(func(k uint64) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if !equalValues(keys, []uint64{1, 3, 4, 5}) {
+		t.Fatal("unexpected keys after commit", keys)
+	}
+	for _, k := range keys {
+		vals, ok := sm.Get(k)
+		if !ok || len(vals) != 1 || vals[0] != k*2 {
+			t.Fatalf("key %d has values %v after commit", k, vals)
+		}
+	}
+}
+
+func TestHeaderFlags(t *testing.T) {
+	os.Remove("flags_testing.8sm")
+	m := New("flags_testing.8sm")
+	mm := Mutate(m, false)
+	mk := mm.OpenKey(1)
+	mk.Put(1)
+	mk.Sync()
+	err := mm.Commit(true)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	orig, err := ioutil.ReadFile("flags_testing.8sm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setFlags := func(flags uint64, version uint32) {
+		data := append([]byte{}, orig...)
+		binary.LittleEndian.PutUint32(data[4:], version)
+		binary.LittleEndian.PutUint64(data[8:], flags)
+		err := ioutil.WriteFile("flags_testing.8sm", data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// unknown optional features are ignored
+	setFlags(1<<63, FormatVersion)
+	m, err = Open("flags_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to open file with unknown optional flag", err)
+	}
+	if _, ok := m.Get(1); !ok {
+		t.Fatal("did not find 1 with unknown optional flag")
+	}
+
+	// unknown required features are rejected
+	setFlags(1<<31, FormatVersion)
+	_, err = Open("flags_testing.8sm")
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatal("expected ErrUnsupported for unknown required flag, got", err)
+	}
+	_, err = OpenMMap("flags_testing.8sm")
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatal("expected ErrUnsupported for unknown required flag (mmap), got", err)
+	}
+
+	// as are future versions
+	setFlags(0, FormatVersion+1)
+	_, err = Open("flags_testing.8sm")
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatal("expected ErrUnsupported for future version, got", err)
+	}
+
+	os.Remove("flags_testing.8sm")
+	os.Remove(lockName("flags_testing.8sm"))
+}
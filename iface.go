@@ -16,9 +16,81 @@ type Map interface {
 	// EachKey calls eachFunc for every key in the map until a non-nil error is returned.
 	EachKey(eachFunc func(uint64) error) error
 
+	// EachKeySorted calls eachFunc for every key in the map in ascending order
+	// until a non-nil error is returned.
+	EachKeySorted(eachFunc func(uint64) error) error
+
+	// EachKeyReverse calls eachFunc for every key in the map in descending order
+	// until a non-nil error is returned.
+	EachKeyReverse(eachFunc func(uint64) error) error
+
+	// EachKeyInRange calls eachFunc in ascending order for every key in the map
+	// where lo <= key <= hi, until a non-nil error is returned.
+	EachKeyInRange(lo, hi uint64, eachFunc func(uint64) error) error
+
+	// EachEntry calls eachFunc with every key and its set of values until a non-nil
+	// error is returned. The vals slice may be reused between calls, so it must be
+	// copied if it is retained after eachFunc returns.
+	EachEntry(eachFunc func(key uint64, vals []uint64) error) error
+
 	// GetSize gets the size of the set of values for the given key
 	GetSize(key uint64) (uint32, bool)
 
 	// GetCapacity gets the capacity reserved for the set of values for the given key
 	GetCapacity(key uint64) (uint32, bool)
+
+	// Reload loads the file again so that changes committed by other processes
+	// are visible. Calls already in progress finish using the previously loaded
+	// generation of the file.
+	Reload() error
+
+	// Snapshot returns a read-only view of the map pinned to the currently
+	// loaded generation of the file. It is not affected by later commits or
+	// reloads, and must be closed to release the file.
+	Snapshot() (Map, error)
+
+	// Generation returns the generation counter of the file when the map was
+	// loaded (see FlagGeneration).
+	Generation() uint64
+
+	// Changed reports whether the file has been committed to by another process
+	// since the map was loaded, in which case it should be reopened.
+	Changed() (bool, error)
+
+	// Close releases the files and memory held by the map. After Close, lookups
+	// will not find any keys and EachKey will return ErrClosed.
+	io.Closer
+}
+
+// Prefetcher is implemented by maps which can ask the operating system to read
+// the sets for some keys into memory ahead of a batch of lookups, such as
+// mmap'd maps.
+type Prefetcher interface {
+	Map
+
+	// Prefetch starts reading the sets of values for the given keys.
+	Prefetch(keys ...uint64) error
+
+	// Warm starts reading the sets of values for all keys where lo <= key <= hi.
+	Warm(lo, hi uint64) error
+}
+
+// CachedMap is implemented by maps which cache the sets of values read from
+// their file, such as maps opened by Open.
+type CachedMap interface {
+	Map
+
+	// Stats returns the counters of the map's cache.
+	Stats() CacheStats
+}
+
+// BitmapMap is implemented by maps which can return sets of values stored as
+// bitmap containers (see FlagBitmaps) without expanding them. The set
+// operations use it to combine dense sets with bitwise AND/OR.
+type BitmapMap interface {
+	Map
+
+	// GetBitmap returns the set of values for the given key if it is stored
+	// as a bitmap container.
+	GetBitmap(key uint64) (Bitmap, bool)
 }
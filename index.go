@@ -0,0 +1,68 @@
+package eightsetmap
+
+import (
+	"bytes"
+	"log"
+	"os"
+
+	"github.com/tysontate/gommap"
+)
+
+// WithDiskIndex makes the map search the sorted lookup table in the file
+// instead of loading every key and offset into memory, so opening a map
+// takes constant time and memory use does not grow with the number of keys.
+// The table is mapped into memory where possible, otherwise each lookup is a
+// binary search using positional reads. Legacy files, which may not be
+// sorted, are always loaded into memory. WithShift is ignored.
+func WithDiskIndex() Option {
+	return func(o *options) {
+		o.index = true
+	}
+}
+
+// mapTable maps the file up to the end of the lookup table, so that searches
+// do not need a read call for every probe. If the file cannot be mapped then
+// the table is read from f.
+func (s *stdState) mapTable(f *os.File) {
+	end := int64(s.start) + int64(s.nkeys)*16
+	x, err := gommap.MapRegion(f.Fd(), 0, end, gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return
+	}
+	s.tableMap = x
+	s.tbl = bytes.NewReader(x)
+}
+
+// indexOffset searches the lookup table for the offset of key.
+func (s *stdState) indexOffset(key uint64) (int64, bool) {
+	t := s.table()
+	i, err := t.search(key)
+	if err != nil {
+		log.Println(err)
+		return 0, false
+	}
+	if i >= t.n {
+		return 0, false
+	}
+	k, offs, err := t.entry(i)
+	if err != nil {
+		log.Println(err)
+		return 0, false
+	}
+	// deleted keys have a zero offset
+	return offs, k == key && offs != 0
+}
+
+// liveKeys returns the number of keys in the lookup table which have not been
+// deleted by an in-place commit.
+func (s *stdState) liveKeys() (uint64, error) {
+	if !s.index {
+		return s.nkeys - s.ndeleted, nil
+	}
+	var n uint64
+	err := s.table().each(0, func(key uint64, offs int64) error {
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,132 @@
+package eightsetmap
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDiskIndex(t *testing.T) {
+	os.Remove("index_testing.8sm")
+	defer os.Remove("index_testing.8sm")
+	defer os.Remove(lockName("index_testing.8sm"))
+
+	present := make(map[uint64]bool)
+	m := New("index_testing.8sm")
+	mm := Mutate(m, false)
+	for k := uint64(1); k <= 2000; k += 2 {
+		present[k] = true
+		mk := mm.OpenKey(k)
+		mk.Put(k)
+		mk.Put(k * 3)
+		mk.Sync()
+	}
+	err := mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	mm.DeleteKey(101)
+	delete(present, 101)
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	x, err := Open("index_testing.8sm", WithDiskIndex())
+	if err != nil {
+		t.Fatal("unable to open map with disk index", err)
+	}
+	defer x.Close()
+	s := x.(*stdMap).state
+	if !s.index || s.offsets != nil {
+		t.Fatal("lookup table was loaded into memory")
+	}
+
+	check := func(msg string, x Map) {
+		for k := uint64(0); k <= 2002; k++ {
+			vals, ok := x.Get(k)
+			if ok != present[k] {
+				t.Fatal(msg, "key", k, "found:", ok)
+			}
+			if ok && (len(vals) != 2 || vals[0] != k || vals[1] != k*3) {
+				t.Fatal(msg, "key", k, "has values", vals)
+			}
+		}
+		var n, last uint64
+		err := x.EachKey(func(k uint64) error {
+			if k <= last {
+				t.Fatal(msg, "keys not walked in order", k, last)
+			}
+			last = k
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(msg, "unable to walk keys", err)
+		}
+		if n != uint64(len(present)) {
+			t.Fatal(msg, "walked", n, "keys instead of", len(present))
+		}
+	}
+	check("open:", x)
+
+	// in-place commits and rewrites through the disk index
+	xm := Mutate(x, false)
+	xm.DeleteKey(201)
+	delete(present, 201)
+	res, err := xm.CommitWithResult(false)
+	if err != nil || !res.InPlace {
+		t.Fatal("expected an in-place commit", err, res.Reason)
+	}
+	check("in-place:", x)
+	mk := xm.OpenKey(2002)
+	mk.Put(2002)
+	mk.Put(6006)
+	mk.Sync()
+	present[2002] = true
+	res, err = xm.CommitWithResult(false)
+	if err != nil || res.InPlace {
+		t.Fatal("expected a rewrite", err, res.Reason)
+	}
+	s = x.(*stdMap).state
+	if !s.index || s.offsets != nil {
+		t.Fatal("rewrite loaded the lookup table into memory")
+	}
+	mk = xm.OpenKey(101)
+	mk.Put(101)
+	mk.Put(303)
+	mk.Sync()
+	present[101] = true
+	err = xm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	xm.DeleteKey(2002)
+	delete(present, 2002)
+	err = xm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	check("rewrite:", x)
+
+	r, err := Verify("index_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to verify", err, r.Problems)
+	}
+
+	// legacy files may be unsorted, so are loaded into memory
+	os.Remove("legacy_testing.8sm")
+	defer os.Remove("legacy_testing.8sm")
+	defer os.Remove(lockName("legacy_testing.8sm"))
+	writeLegacy(t, "legacy_testing.8sm", nil, []uint64{3, 1, 2})
+	lm, err := Open("legacy_testing.8sm", WithDiskIndex())
+	if err != nil {
+		t.Fatal("unable to open legacy map", err)
+	}
+	defer lm.Close()
+	if lm.(*stdMap).state.index {
+		t.Fatal("disk index used for a legacy file")
+	}
+	if vals, ok := lm.Get(1); !ok || vals[0] != 2 {
+		t.Fatal("legacy key not found", vals)
+	}
+}
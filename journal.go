@@ -0,0 +1,219 @@
+package eightsetmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+////////
+//
+// In-place commits are logged to <file>.journal before the map file is
+// modified, and the journal is removed once all writes have been synced:
+//
+// uint32 magic 'j8sj'
+// uint32 number of writes
+// for each write:
+//     uint64 offset, uint32 length, [length]byte data
+// uint32 CRC32C of all of the above
+//
+// A complete journal found when opening the map is replayed, an incomplete
+// one is discarded since the map file was not modified yet.
+//
+////////
+
+// journalMagic is the magic number at the start of a journal file.
+const journalMagic = 0x6a73386a
+
+// readerWriterAt is implemented by both *os.File and *journal.
+type readerWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// journalName returns the name of the journal file for filename.
+func journalName(filename string) string {
+	return filename + ".journal"
+}
+
+type journalWrite struct {
+	offs int64
+	data []byte
+}
+
+// journal collects the writes for an in-place commit instead of applying
+// them. Reads see the pending writes on top of the underlying file.
+type journal struct {
+	r      io.ReaderAt
+	writes []journalWrite
+}
+
+// WriteAt records a pending write.
+func (j *journal) WriteAt(p []byte, off int64) (int, error) {
+	j.writes = append(j.writes, journalWrite{offs: off, data: append([]byte{}, p...)})
+	return len(p), nil
+}
+
+// ReadAt reads from the underlying file, then applies any pending writes.
+func (j *journal) ReadAt(p []byte, off int64) (int, error) {
+	n, err := j.r.ReadAt(p, off)
+	end := off + int64(len(p))
+	for _, w := range j.writes {
+		wend := w.offs + int64(len(w.data))
+		if wend <= off || w.offs >= end {
+			continue
+		}
+		src := w.data
+		dst := p
+		if w.offs < off {
+			src = src[off-w.offs:]
+		} else {
+			dst = dst[w.offs-off:]
+		}
+		copy(dst, src)
+	}
+	return n, err
+}
+
+// commit logs the pending writes to the journal file and then applies them
+// to filename. If the journal could not be written then the map file is
+// untouched and applied is false.
+func (j *journal) commit(filename string) (applied bool, err error) {
+	err = writeJournal(filename, j.writes)
+	if err != nil {
+		os.Remove(journalName(filename))
+		return false, err
+	}
+	return true, applyJournal(filename, j.writes)
+}
+
+// writeJournal durably writes the journal file for filename.
+func writeJournal(filename string, writes []journalWrite) error {
+	f, err := os.Create(journalName(filename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	crc := crc32.New(castagnoli)
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
+	var hdr [12]byte
+	binary.LittleEndian.PutUint32(hdr[:], journalMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(writes)))
+	w.Write(hdr[:8])
+	for _, jw := range writes {
+		binary.LittleEndian.PutUint64(hdr[:], uint64(jw.offs))
+		binary.LittleEndian.PutUint32(hdr[8:], uint32(len(jw.data)))
+		w.Write(hdr[:])
+		w.Write(jw.data)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(hdr[:], crc.Sum32())
+	_, err = f.Write(hdr[:4])
+	if err != nil {
+		return err
+	}
+	return syncFile(f)
+}
+
+// readJournal decodes the journal in data, returning false if it is
+// incomplete or corrupt.
+func readJournal(data []byte) ([]journalWrite, bool) {
+	if len(data) < 12 || binary.LittleEndian.Uint32(data) != journalMagic {
+		return nil, false
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, castagnoli) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, false
+	}
+
+	n := binary.LittleEndian.Uint32(body[4:])
+	body = body[8:]
+	writes := make([]journalWrite, 0, n)
+	for i := uint32(0); i < n; i++ {
+		if len(body) < 12 {
+			return nil, false
+		}
+		offs := int64(binary.LittleEndian.Uint64(body))
+		l := binary.LittleEndian.Uint32(body[8:])
+		body = body[12:]
+		if uint64(len(body)) < uint64(l) {
+			return nil, false
+		}
+		writes = append(writes, journalWrite{offs: offs, data: body[:l]})
+		body = body[l:]
+	}
+	return writes, len(body) == 0
+}
+
+// applyJournal applies the writes to filename, syncs it, and then removes
+// the journal file.
+func applyJournal(filename string, writes []journalWrite) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, jw := range writes {
+		_, err = f.WriteAt(jw.data, jw.offs)
+		if err != nil {
+			return err
+		}
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	return removeJournal(filename)
+}
+
+// removeJournal durably removes the journal file for filename.
+func removeJournal(filename string) error {
+	err := os.Remove(journalName(filename))
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+// replayJournal completes an in-place commit to filename that was
+// interrupted, or discards it if it was not fully logged.
+func replayJournal(filename string) error {
+	data, err := ioutil.ReadFile(journalName(filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	writes, ok := readJournal(data)
+	if !ok {
+		return removeJournal(filename)
+	}
+	return applyJournal(filename, writes)
+}
+
+// replayLockedJournal replays the journal for filename, if there is one,
+// while holding an exclusive lock so that readers do not see a partial commit.
+func replayLockedJournal(filename string) error {
+	if _, err := os.Stat(journalName(filename)); err != nil {
+		return nil
+	}
+	l, err := lockExclusive(filename)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+	err = replayJournal(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package eightsetmap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	os.Remove("journal_testing.8sm")
+	m := New("journal_testing.8sm")
+	mm := Mutate(m, false)
+	for k := uint64(1); k <= 20; k++ {
+		mk := mm.OpenKey(k)
+		mk.Put(k)
+		mk.Sync()
+	}
+	err := mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	orig, err := ioutil.ReadFile("journal_testing.8sm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mk := mm.OpenKey(5)
+	mk.Put(500)
+	mk.Sync()
+	mm.DeleteKey(7)
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	if _, err = os.Stat(journalName("journal_testing.8sm")); !os.IsNotExist(err) {
+		t.Fatal("journal left behind after in-place commit", err)
+	}
+	after, err := ioutil.ReadFile("journal_testing.8sm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(orig) {
+		t.Fatal("expected an in-place commit")
+	}
+
+	// the changed bytes, as they would have been journaled
+	var writes []journalWrite
+	for i := 0; i < len(orig); i++ {
+		if orig[i] != after[i] {
+			writes = append(writes, journalWrite{offs: int64(i), data: after[i : i+1]})
+		}
+	}
+
+	check := func(msg string, expected []byte) {
+		m, err := Open("journal_testing.8sm")
+		if err != nil {
+			t.Fatal(msg, "unable to open map", err)
+		}
+		m.Close()
+		data, _ := ioutil.ReadFile("journal_testing.8sm")
+		if !bytes.Equal(data, expected) {
+			t.Fatal(msg, "unexpected file contents")
+		}
+		if _, err = os.Stat(journalName("journal_testing.8sm")); !os.IsNotExist(err) {
+			t.Fatal(msg, "journal not removed", err)
+		}
+	}
+
+	// crashed before applying any writes
+	ioutil.WriteFile("journal_testing.8sm", orig, 0644)
+	err = writeJournal("journal_testing.8sm", writes)
+	if err != nil {
+		t.Fatal("unable to write journal", err)
+	}
+	check("replay:", after)
+	vals, ok := New("journal_testing.8sm").Get(5)
+	if !ok || len(vals) != 2 || vals[1] != 500 {
+		t.Fatal("replayed key not updated", vals)
+	}
+	if _, ok = New("journal_testing.8sm").Get(7); ok {
+		t.Fatal("replayed delete not applied")
+	}
+
+	// crashed halfway through applying the writes
+	half := append([]byte{}, orig...)
+	for _, w := range writes[:len(writes)/2] {
+		copy(half[w.offs:], w.data)
+	}
+	ioutil.WriteFile("journal_testing.8sm", half, 0644)
+	writeJournal("journal_testing.8sm", writes)
+	check("partial replay:", after)
+
+	// crashed while writing the journal
+	ioutil.WriteFile("journal_testing.8sm", orig, 0644)
+	writeJournal("journal_testing.8sm", writes)
+	jdata, _ := ioutil.ReadFile(journalName("journal_testing.8sm"))
+	ioutil.WriteFile(journalName("journal_testing.8sm"), jdata[:len(jdata)-3], 0644)
+	check("incomplete journal:", orig)
+
+	// Recover also replays the journal
+	writeJournal("journal_testing.8sm", writes)
+	err = Recover("journal_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to recover", err)
+	}
+	check("recover:", after)
+
+	r, err := Verify("journal_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to verify replayed file", err, r.Problems)
+	}
+
+	os.Remove("journal_testing.8sm")
+	os.Remove(lockName("journal_testing.8sm"))
+}
@@ -0,0 +1,148 @@
+package eightsetmap
+
+import (
+	"encoding/binary"
+	"log"
+	"sort"
+)
+
+// WithLazyMMap makes OpenMMap (or MMap of a map opened with it) keep only the
+// mapped file, and decode each set when it is requested instead of building
+// slices for every key up front. Lookups search the sorted lookup table in the
+// mapped file, or use an index of the shifted keys if WithShift is also given.
+// Legacy files whose lookup table is not sorted are loaded up front instead,
+// unless they are shifted, which fails with ErrUnsorted.
+func WithLazyMMap() Option {
+	return func(o *options) {
+		o.lazy = true
+	}
+}
+
+// loadLazy prepares a lazily decoded state, building the index of shifted
+// keys if shift is non-zero.
+func (m *memState) loadLazy(shift uint64) error {
+	m.lazy = true
+	m.shiftkey = shift
+	if shift == 0 {
+		return nil
+	}
+
+	m.offsets = make(map[uint64]int64)
+	var lastkey uint64
+	for i := uint64(0); i < m.table.n; i++ {
+		key, _ := m.entry(i)
+		if key < lastkey {
+			return ErrUnsorted
+		}
+		lastkey = key
+		if _, exists := m.offsets[key>>shift]; !exists {
+			m.offsets[key>>shift] = int64(i)
+		}
+	}
+	return nil
+}
+
+// sortedTable returns true if the keys in the mapped lookup table are in
+// increasing order, so that it can be searched.
+func (m *memState) sortedTable() bool {
+	for i := uint64(1); i < m.table.n; i++ {
+		prev, _ := m.entry(i - 1)
+		key, _ := m.entry(i)
+		if key <= prev {
+			return false
+		}
+	}
+	return true
+}
+
+// entry returns the i'th key and offset in the mapped lookup table.
+func (m *memState) entry(i uint64) (uint64, int64) {
+	p := m.table.start + int64(i)*16
+	return binary.LittleEndian.Uint64(m.mmap[p:]), int64(binary.LittleEndian.Uint64(m.mmap[p+8:]))
+}
+
+// offset finds the offset of the set of values for key in the mapped file.
+func (m *memState) offset(key uint64) (int64, bool) {
+	n := m.table.n
+	if m.shiftkey > 0 {
+		first, ok := m.offsets[key>>m.shiftkey]
+		if !ok {
+			return 0, false
+		}
+		for i := uint64(first); i < n; i++ {
+			k, offs := m.entry(i)
+			if k>>m.shiftkey != key>>m.shiftkey {
+				break
+			}
+			if k == key {
+				return offs, offs != 0
+			}
+		}
+		return 0, false
+	}
+
+	i := uint64(sort.Search(int(n), func(i int) bool {
+		k, _ := m.entry(uint64(i))
+		return k >= key
+	}))
+	if i == n {
+		return 0, false
+	}
+	k, offs := m.entry(i)
+	// deleted keys have a zero offset
+	return offs, k == key && offs != 0
+}
+
+// block finds the caplen for key and the offset of its values.
+func (m *memState) block(key uint64) (uint64, int64, bool) {
+	offs, ok := m.offset(key)
+	if !ok {
+		return 0, 0, false
+	}
+	size := int64(len(m.mmap))
+	if offs < 0 || offs+8 > size {
+		log.Printf("eightsetmap: invalid value set for key %d", key)
+		return 0, 0, false
+	}
+	caplen := binary.LittleEndian.Uint64(m.mmap[offs:])
+	if !validBlock(size, offs, caplen, m.flags) {
+		log.Printf("eightsetmap: invalid value set for key %d", key)
+		return 0, 0, false
+	}
+	return caplen, offs + 8, true
+}
+
+// lazyGet decodes the set of values for key, and returns any extra data
+// stored after them. Uncompressed sets point directly into the mapped file.
+func (m *memState) lazyGet(key uint64) ([]uint64, []byte, bool) {
+	caplen, offs, ok := m.block(key)
+	if !ok {
+		return nil, nil, false
+	}
+	end := offs + int64(blockCap(caplen))*8
+	if m.flags&FlagDeltaVarint == 0 && caplen&bitmapBlock == 0 {
+		l := offs + int64(uint32(caplen))*8
+		return touint64(m.mmap[offs:l]), m.mmap[l:end], true
+	}
+	vals, n, err := decodeValues(nil, m.mmap[offs:end], caplen, m.flags)
+	if err != nil {
+		log.Printf("eightsetmap: key %d: %v", key, err)
+		return nil, nil, false
+	}
+	return vals, m.mmap[offs+int64(n) : end], true
+}
+
+// lazyBitmap decodes the set of values for key if it is stored as a bitmap
+// container.
+func (m *memState) lazyBitmap(key uint64) (Bitmap, bool) {
+	caplen, offs, ok := m.block(key)
+	if !ok || caplen&bitmapBlock == 0 {
+		return Bitmap{}, false
+	}
+	bm, _, err := decodeBitmap(m.mmap[offs : offs+int64(blockCap(caplen))*8])
+	if err != nil {
+		log.Printf("eightsetmap: key %d: %v", key, err)
+		return Bitmap{}, false
+	}
+	return bm, true
+}
@@ -0,0 +1,157 @@
+package eightsetmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestLazyMMap(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		os.Remove("lazy_testing.8sm")
+		w, err := NewAppendWriter("lazy_testing.8sm")
+		if err != nil {
+			t.Fatal("unable to create writer", err)
+		}
+		w.SetPacker(keyPacker)
+		w.SetCompression(compressed)
+		w.SetBitmaps(true)
+		for k := uint64(3); k < 3000; k += 3 {
+			vals := make([]uint64, k%50)
+			for i := range vals {
+				vals[i] = uint64(i) * (k%4 + 1)
+			}
+			err = w.Append(k, vals)
+			if err != nil {
+				t.Fatal("unable to append key", k, err)
+			}
+		}
+		m, err := w.Finish()
+		if err != nil {
+			t.Fatal("unable to finish writing", err)
+		}
+		mm := Mutate(m, false)
+		mm.DeleteKey(300)
+		err = mm.Commit(false)
+		if err != nil {
+			t.Fatal("unable to commit changes", err)
+		}
+
+		eager, err := OpenMMap("lazy_testing.8sm")
+		if err != nil {
+			t.Fatal("unable to mmap map", err)
+		}
+		for _, shift := range []uint64{0, 4} {
+			lazy, err := OpenMMap("lazy_testing.8sm", WithLazyMMap(), WithShift(shift))
+			if err != nil {
+				t.Fatal("unable to lazily mmap map", err)
+			}
+			if s := lazy.(*memMap).state; !s.lazy || s.nodes != nil {
+				t.Fatal("sets were loaded up front")
+			}
+
+			for k := uint64(0); k < 3003; k++ {
+				want, wok := eager.Get(k)
+				got, ok := lazy.Get(k)
+				if ok != wok || !equalValues(got, want) {
+					t.Fatalf("shift %d compressed %v: key %d has %v (%v), expected %v (%v)", shift, compressed, k, got, ok, want, wok)
+				}
+				if !ok {
+					continue
+				}
+				if n, _ := lazy.GetSize(k); n != uint32(len(want)) {
+					t.Fatal("key", k, "has size", n, "expected", len(want))
+				}
+				wc, _ := m.GetCapacity(k)
+				if c, _ := lazy.GetCapacity(k); c != wc {
+					t.Fatal("key", k, "has capacity", c, "expected", wc)
+				}
+				var extra []uint64
+				lazy.GetWithExtra(k, func(n int, r io.Reader) {
+					extra = make([]uint64, n)
+					binary.Read(r, binary.LittleEndian, extra)
+				})
+				if len(extra) < 2 || extra[0] != k || extra[1] != uint64(len(want)) {
+					t.Fatal("key", k, "has extra data", extra)
+				}
+				wbm, wok := eager.(BitmapMap).GetBitmap(k)
+				bm, ok := lazy.(BitmapMap).GetBitmap(k)
+				if ok != wok || !equalValues(bm.Values(nil), wbm.Values(nil)) {
+					t.Fatal("key", k, "has a different bitmap")
+				}
+			}
+			if _, ok := lazy.Get(300); ok {
+				t.Fatal("deleted key found")
+			}
+
+			var n int
+			err = lazy.EachKey(func(k uint64) error {
+				n++
+				return nil
+			})
+			if err != nil || n != 998 {
+				t.Fatal("walked", n, "keys instead of 998", err)
+			}
+			lazy.Close()
+		}
+		eager.Close()
+		m.Close()
+	}
+	os.Remove("lazy_testing.8sm")
+	os.Remove(lockName("lazy_testing.8sm"))
+
+	// legacy files are only searched lazily when their table is sorted
+	os.Remove("legacy_testing.8sm")
+	writeLegacy(t, "legacy_testing.8sm", nil, []uint64{1, 2, 3})
+	lm, err := OpenMMap("legacy_testing.8sm", WithLazyMMap())
+	if err != nil {
+		t.Fatal("unable to mmap legacy map", err)
+	}
+	if !lm.(*memMap).state.lazy {
+		t.Fatal("sorted legacy file not loaded lazily")
+	}
+	if vals, ok := lm.Get(3); !ok || len(vals) != 1 || vals[0] != 6 {
+		t.Fatal("legacy key not found", vals)
+	}
+	lm.Close()
+	lm, err = OpenMMap("legacy_testing.8sm", WithLazyMMap(), WithShift(1))
+	if err != nil {
+		t.Fatal("unable to mmap legacy map", err)
+	}
+	if vals, ok := lm.Get(2); !ok || len(vals) != 1 || vals[0] != 4 {
+		t.Fatal("legacy key not found", vals)
+	}
+	lm.Close()
+	writeLegacy(t, "legacy_testing.8sm", nil, []uint64{3, 1, 2})
+	lm, err = OpenMMap("legacy_testing.8sm", WithLazyMMap())
+	if err != nil {
+		t.Fatal("unable to mmap legacy map", err)
+	}
+	if lm.(*memMap).state.lazy {
+		t.Fatal("unsorted legacy file loaded lazily")
+	}
+	if vals, ok := lm.Get(1); !ok || len(vals) != 1 || vals[0] != 2 {
+		t.Fatal("legacy key not found", vals)
+	}
+	lm.Close()
+	_, err = OpenMMap("legacy_testing.8sm", WithLazyMMap(), WithShift(1))
+	if !errors.Is(err, ErrUnsorted) {
+		t.Fatal("expected ErrUnsorted, got", err)
+	}
+	os.Remove("legacy_testing.8sm")
+	os.Remove(lockName("legacy_testing.8sm"))
+}
+
+func equalValues(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package eightsetmap
+
+import (
+	"errors"
+	"os"
+)
+
+// FlagGeneration is an optional feature flag for files where the generation
+// counter in the header is incremented by every commit, including in-place
+// commits. Readers in other processes can compare it to detect that the file
+// changed under them, see Map.Changed.
+const FlagGeneration uint64 = 1 << 33
+
+////////
+//
+// Processes sharing a map coordinate with advisory locks on <file>.lock,
+// which (unlike the map file) is never replaced. Readers hold a shared lock
+// while loading the map, and writers hold an exclusive lock while modifying
+// or replacing the map file. A rewrite checks, under the exclusive lock, that
+// the file was not replaced or committed to since it was loaded, see ErrStale.
+//
+// Lock files are left in place, even after the map file is removed or renamed
+// away: removing one while another process has it open would let two writers
+// lock different files. They are empty, and can be removed along with the map
+// once no process is using it.
+//
+////////
+
+// lockName returns the name of the lock file for filename.
+func lockName(filename string) string {
+	return filename + ".lock"
+}
+
+// fileLock is a held advisory lock on the lock file for a map.
+type fileLock struct {
+	f *os.File
+}
+
+// lockShared waits for a shared lock on the lock file for filename. If the
+// map does not exist then no lock file is created, and if the lock file cannot
+// be created (e.g. in a read-only directory) then the map is used without
+// locking.
+func lockShared(filename string) (*fileLock, error) {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return &fileLock{}, nil
+	}
+	f, err := os.OpenFile(lockName(filename), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		f, err = os.Open(lockName(filename))
+		if err != nil {
+			return &fileLock{}, nil
+		}
+	}
+	err = flock(f, false)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+// lockExclusive waits for an exclusive lock on the lock file for filename.
+func lockExclusive(filename string) (*fileLock, error) {
+	f, err := os.OpenFile(lockName(filename), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = flock(f, true)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+// unlock releases the lock.
+func (l *fileLock) unlock() {
+	if l.f != nil {
+		funlock(l.f)
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+// readLockedHeader reads the header of filename while holding a shared lock.
+func readLockedHeader(filename string) (*Header, error) {
+	l, err := lockShared(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+	return ReadHeader(filename)
+}
+
+// fileChanged reports whether the generation of filename differs from gen.
+func fileChanged(filename string, gen uint64) (bool, error) {
+	h, err := readLockedHeader(filename)
+	if err != nil {
+		if errors.Is(err, ErrNotExist) {
+			return gen != 0, nil
+		}
+		return false, err
+	}
+	return h.Generation != gen, nil
+}
+
+// Generation returns the generation counter of the file when the map was loaded.
+func (m *stdMap) Generation() uint64 {
+	s := m.acquire()
+	if s == nil {
+		return 0
+	}
+	defer s.release()
+	return s.gen
+}
+
+// Changed reports whether the file has been committed to since the map was loaded.
+func (m *stdMap) Changed() (bool, error) {
+	return fileChanged(m.filename, m.Generation())
+}
+
+// Generation returns the generation counter of the file when the map was loaded.
+func (m *memMap) Generation() uint64 {
+	s := m.acquire()
+	if s == nil {
+		return 0
+	}
+	defer s.release()
+	return s.gen
+}
+
+// Changed reports whether the file has been committed to since the map was loaded.
+func (m *memMap) Changed() (bool, error) {
+	return fileChanged(m.filename, m.Generation())
+}
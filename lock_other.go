@@ -0,0 +1,22 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package eightsetmap
+
+import "os"
+
+// flock is a no-op where advisory file locks are not supported, so processes
+// sharing a map must coordinate by other means.
+func flock(f *os.File, exclusive bool) error {
+	return nil
+}
+
+// tryFlock always succeeds where advisory file locks are not supported.
+func tryFlock(f *os.File) (bool, error) {
+	return true, nil
+}
+
+// funlock is a no-op where advisory file locks are not supported.
+func funlock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,250 @@
+package eightsetmap
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestGeneration(t *testing.T) {
+	os.Remove("generation_testing.8sm")
+	defer os.Remove("generation_testing.8sm")
+	defer os.Remove(lockName("generation_testing.8sm"))
+
+	m := New("generation_testing.8sm")
+	if m.Generation() != 0 {
+		t.Fatal("unexpected generation for a new map", m.Generation())
+	}
+	mm := Mutate(m, false)
+	for k := uint64(1); k <= 20; k++ {
+		mk := mm.OpenKey(k)
+		mk.Put(k)
+		mk.Sync()
+	}
+	err := mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	if m.Generation() != 1 {
+		t.Fatal("expected generation 1 after rewrite, got", m.Generation())
+	}
+
+	reader, err := Open("generation_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to open map", err)
+	}
+	defer reader.Close()
+	if reader.Generation() != 1 {
+		t.Fatal("expected reader at generation 1, got", reader.Generation())
+	}
+	changed, err := reader.Changed()
+	if err != nil || changed {
+		t.Fatal("reader should not see a change", changed, err)
+	}
+
+	// in-place commit
+	mk := mm.OpenKey(5)
+	mk.Put(500)
+	mk.Sync()
+	res, err := mm.CommitWithResult(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	if !res.InPlace {
+		t.Fatal("expected an in-place commit:", res.Reason)
+	}
+	if m.Generation() != 2 {
+		t.Fatal("expected generation 2 after in-place commit, got", m.Generation())
+	}
+	changed, err = reader.Changed()
+	if err != nil || !changed {
+		t.Fatal("reader should see the in-place commit", changed, err)
+	}
+	changed, err = m.Changed()
+	if err != nil || changed {
+		t.Fatal("writer should not see its own commit as a change", changed, err)
+	}
+	r, err := Verify("generation_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to verify after in-place commit", err, r.Problems)
+	}
+
+	mreader, err := OpenMMap("generation_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to mmap map", err)
+	}
+	defer mreader.Close()
+	if mreader.Generation() != 2 {
+		t.Fatal("expected mmap reader at generation 2, got", mreader.Generation())
+	}
+
+	// rewrite
+	mk = mm.OpenKey(100)
+	mk.Put(1)
+	mk.Sync()
+	res, err = mm.CommitWithResult(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	if res.InPlace || m.Generation() != 3 {
+		t.Fatal("expected generation 3 after rewrite, got", m.Generation())
+	}
+	changed, err = mreader.Changed()
+	if err != nil || !changed {
+		t.Fatal("mmap reader should see the rewrite", changed, err)
+	}
+	h, err := ReadHeader("generation_testing.8sm")
+	if err != nil || h.Generation != 3 || h.Flags&FlagGeneration == 0 {
+		t.Fatal("unexpected header after rewrite", h, err)
+	}
+
+	// commits without changes must not bump the generation, even after the
+	// first commit to a new map added the checksum and generation flags
+	os.Remove("generation_testing2.8sm")
+	defer os.Remove("generation_testing2.8sm")
+	defer os.Remove(lockName("generation_testing2.8sm"))
+	nm := New("generation_testing2.8sm")
+	amm := Mutate(nm, true)
+	amm.OpenKey(1).Put(1)
+	for _, commit := range []func() error{
+		func() error { return amm.Commit(true) },
+		func() error { return amm.Commit(true) },
+		func() error { return amm.Commit(false) },
+		func() error { return amm.CommitWithPacker(DefaultPacker) },
+	} {
+		err = commit()
+		if err != nil || nm.Generation() != 1 {
+			t.Fatal("commit without changes moved to generation", nm.Generation(), err)
+		}
+	}
+
+	// AppendWriter continues the generation of the file it replaces
+	w, err := NewAppendWriter("generation_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to create append writer", err)
+	}
+	w.Append(1, []uint64{1, 2, 3})
+	am, err := w.Finish()
+	if err != nil {
+		t.Fatal("unable to finish append writer", err)
+	}
+	defer am.Close()
+	if am.Generation() != 4 {
+		t.Fatal("expected generation 4 after append writer, got", am.Generation())
+	}
+}
+
+func TestStaleRewrite(t *testing.T) {
+	os.Remove("stale_testing.8sm")
+	defer os.Remove("stale_testing.8sm")
+	defer os.Remove(lockName("stale_testing.8sm"))
+
+	put := func(mm *MutableMap, key, val uint64) error {
+		mk := mm.OpenKey(key)
+		mk.Put(val)
+		mk.Sync()
+		return mm.Commit(false)
+	}
+	a := New("stale_testing.8sm")
+	ma := Mutate(a, false)
+	for k := uint64(1); k <= 5; k++ {
+		if err := put(ma, k, k); err != nil {
+			t.Fatal("unable to commit changes", err)
+		}
+	}
+	b := New("stale_testing.8sm")
+	mb := Mutate(b, false)
+
+	// an in-place commit by another writer bumps the generation
+	if err := put(ma, 1, 100); err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	err := put(mb, 10, 10)
+	if !errors.Is(err, ErrStale) {
+		t.Fatal("expected ErrStale after an in-place commit by another writer, got", err)
+	}
+	if err = b.Reload(); err != nil {
+		t.Fatal("unable to reload", err)
+	}
+	if err = mb.Commit(false); err != nil {
+		t.Fatal("unable to commit changes after reload", err)
+	}
+
+	// a rewrite by another writer replaces the file
+	err = put(ma, 11, 11)
+	if !errors.Is(err, ErrStale) {
+		t.Fatal("expected ErrStale after a rewrite by another writer, got", err)
+	}
+	if err = a.Reload(); err != nil {
+		t.Fatal("unable to reload", err)
+	}
+	if err = ma.Commit(false); err != nil {
+		t.Fatal("unable to commit changes after reload", err)
+	}
+
+	x := New("stale_testing.8sm")
+	for k, want := range map[uint64]int{1: 2, 10: 1, 11: 1} {
+		if vals, ok := x.Get(k); !ok || len(vals) != want {
+			t.Fatal("unexpected values for key", k, vals)
+		}
+	}
+}
+
+func TestLocking(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("advisory locks are not supported")
+	}
+	// shared locks on a missing map do not create a lock file
+	os.Remove("locking_testing.8sm")
+	l, err := lockShared("locking_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to take shared lock", err)
+	}
+	l.unlock()
+	if _, err = os.Stat(lockName("locking_testing.8sm")); !os.IsNotExist(err) {
+		t.Fatal("lock file created for a missing map", err)
+	}
+
+	err = ioutil.WriteFile("locking_testing.8sm", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("locking_testing.8sm")
+	defer os.Remove(lockName("locking_testing.8sm"))
+
+	shared, err := lockShared("locking_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to take shared lock", err)
+	}
+	shared2, err := lockShared("locking_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to take a second shared lock", err)
+	}
+
+	locked := make(chan *fileLock)
+	go func() {
+		l, err := lockExclusive("locking_testing.8sm")
+		if err != nil {
+			t.Error("unable to take exclusive lock", err)
+		}
+		locked <- l
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("exclusive lock taken while shared locks are held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	shared.unlock()
+	shared2.unlock()
+
+	select {
+	case l := <-locked:
+		l.unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("exclusive lock not taken after shared locks released")
+	}
+}
@@ -5,26 +5,77 @@ package eightsetmap
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/hashicorp/golang-lru"
+	"github.com/tysontate/gommap"
 )
 
 const (
-	// Magic header uint32 = 'j8sm' defines the file type.
+	// Magic header uint32 = 'j8sm' defines the legacy file type.
 	MAGIC uint32 = 0x6d73386a
 )
 
 var (
-	// DefaultCacheSize is the number of keys to keep in a LRU cache for each map.
+	// ErrBadMagic is returned when a file does not start with the MAGIC header.
+	ErrBadMagic = errors.New("not an 8sm file (magic invalid)")
+
+	// ErrTruncated is returned when a file ends before all of its data could be read.
+	ErrTruncated = errors.New("file is truncated")
+
+	// ErrUnsorted is returned when a shift is requested but the keys are not sorted.
+	ErrUnsorted = errors.New("keys are not sorted, cannot use shift until repacked")
+
+	// ErrUnsupported is returned when a file uses a format version or required
+	// feature that this package does not understand.
+	ErrUnsupported = errors.New("unsupported file format")
+
+	// ErrCorrupt is returned when a file contains invalid data or checksums.
+	ErrCorrupt = errors.New("file is corrupt")
+
+	// ErrNotExist is returned by Open when the file does not exist.
+	ErrNotExist = errors.New("file does not exist")
+
+	// ErrClosed is returned when using a Map after Close has been called.
+	ErrClosed = errors.New("eightsetmap: map is closed")
+
+	// ErrSnapshot is returned when reloading a snapshot, which is pinned to
+	// one generation of the file.
+	ErrSnapshot = errors.New("eightsetmap: snapshots cannot be reloaded")
+
+	// ErrStale is returned by a commit when another writer has committed to
+	// the file since the map was loaded. The changes are kept, so they can be
+	// committed again after a Reload.
+	ErrStale = errors.New("file was changed since the map was loaded")
+
+	// errStopIteration is used internally to end a walk over the lookup table early.
+	errStopIteration = errors.New("stop iteration")
+)
+
+var (
+	// DefaultCacheBytes is the total size of the sets kept in the default
+	// cache for each map, see NewSizedCache.
+	DefaultCacheBytes int64 = 64 << 20
+
+	// DefaultCacheSize is the number of keys kept in the default cache for
+	// each map, and by caches limited by count such as NewLRUCache when no
+	// size is given.
 	DefaultCacheSize = 65535
+
+	// ScanBufferSize is the read buffer size used by EachEntry to stream the
+	// backing file.
+	ScanBufferSize = 16 << 20
 )
 
 ////////
 //
-// uint64 [num_keys]
+// header (see header.go)
 // [num_keys][2]uint64 [key, offset]  (sorted by key)
 //
 // uint64 caplen [uint32 capacity, uint32 length]
@@ -33,36 +84,100 @@ var (
 ////////
 
 // Map represents a out-of-core map from uint64 keys to sets of uint64 values.
+//
+// A stdMap is safe for use by many concurrent readers. Each call uses the
+// state loaded from one generation of the file, so calls in progress and
+// snapshots are not disturbed by Reload or by commits from a MutableMap.
 type stdMap struct {
 	filename string
-	f        *os.File // readonly file
-	start    int      // lookup table start offset
+	opts     options
+	snapshot bool // pinned to one state, see Snapshot
+
+	mu     sync.RWMutex // guards state and closed
+	state  *stdState
+	closed bool
+	stop   chan struct{} // closed to stop the watcher, if any
+	stats  CacheStats    // counters from the caches of previous states
+
+	// held by Reload and by commits which replace the file, so that a reload
+	// cannot publish the previous file over the one written by a commit
+	replacing sync.Mutex
+
+	// Data contains the custom data embedded within the on-disk format.
+	Data []byte
+}
+
+// stdState is the lookup table and backing file of a stdMap as loaded from
+// one generation of the file. A new state is published when the file is
+// reloaded or rewritten, and the old one is closed once it is not in use.
+type stdState struct {
+	filename string
+	f        *os.File    // readonly backing file, nil if it did not exist
+	info     os.FileInfo // of f when it was loaded
+	start    int         // lookup table start offset
+	nkeys    uint64      // number of entries in the lookup table
+	ndeleted uint64      // number of lookup table entries deleted in-place
+	version  uint32      // format version from the file header
+	flags    uint64      // feature flags from the file header
+	gen      uint64      // generation from the file header
+	size     int64       // size of the backing file
+	data     []byte      // custom data from the file header
 
 	// 1 billion keys here will easily take over 16gb...
 	offsets  map[uint64]int64
 	shiftkey uint64
+	unsorted bool // the legacy lookup table cannot be walked in key order
 
-	//cache map[uint64][]uint64
-	cache *lru.Cache
+	// with a disk index the offsets are not loaded, and the lookup table is
+	// searched through tbl instead (see WithDiskIndex)
+	index    bool
+	tbl      io.ReaderAt
+	tableMap gommap.MMap
 
-	// Data contains the custom data embedded within the on-disk format.
-	Data []byte
+	cache Cache
+
+	refs      int32 // calls and snapshots using the state, plus one while it is current
+	snapshots int32 // snapshots using the state
 }
 
 // MutableMap represents a Map that can be written to.
 type MutableMap struct {
 	Map         *stdMap
 	newFilename string
+	flags       uint64 // feature flags for the next commit
 
 	// not yet committed to disk
 	dirty   map[uint64][]uint64
+	deleted map[uint64]struct{}
 	mutkeys map[uint64]*MutableKey
 
 	// should keys be auto-synced?
 	autosync bool
 }
 
+// Option configures how Open loads a Map.
+type Option func(*options)
+
+type options struct {
+	shift  uint64
+	watch  time.Duration
+	index  bool
+	lazy   bool
+	advice Advice
+	cache  func() Cache
+}
+
+// WithShift enables shifting to reduce core memory usage, see NewShifted.
+func WithShift(shift uint64) Option {
+	return func(o *options) {
+		o.shift = shift
+	}
+}
+
 // New returns a new Map backed by the (possibly empty) data in filename.
+//
+// New panics if the file exists but cannot be loaded, see Open for an
+// error-returning alternative.
 func New(filename string) Map {
 	return NewShifted(filename, 0)
 }
@@ -70,119 +185,426 @@ func New(filename string) Map {
 // NewShifted returns a Map with shifting enabled to reduce core memory usage.
 // A shift is a power of 2 factor, so shift=1 means that memory usage is
 // approximately cut in half, but that lookups will take additional disk seeks.
+//
+// NewShifted panics if the file exists but cannot be loaded, see Open for an
+// error-returning alternative.
 func NewShifted(filename string, shift uint64) Map {
-	var cdata []byte
-	offs := make(map[uint64]int64)
+	m, err := openStdMap(filename, &options{shift: shift})
+	if err != nil && !errors.Is(err, ErrNotExist) {
+		panic(err)
+	}
+	return m
+}
+
+// Open returns a Map backed by the data in filename. Unlike New, the file must
+// already exist, and any problems loading it are returned as an error that
+// can be checked with errors.Is against ErrBadMagic, ErrTruncated, ErrUnsorted
+// and ErrNotExist.
+func Open(filename string, opts ...Option) (Map, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	m, err := openStdMap(filename, o)
+	if err != nil {
+		return nil, err
+	}
+	if o.watch > 0 {
+		m.stop = make(chan struct{})
+		go watchFile(filename, o.watch, m.stop, m.loadedInfo, m.Reload)
+	}
+	return m, nil
+}
+
+// openStdMap loads the lookup table from filename. If the file does not exist
+// then an empty (but usable) map is returned along with ErrNotExist.
+func openStdMap(filename string, o *options) (*stdMap, error) {
+	s, err := loadStdState(filename, o)
+	if s == nil {
+		return nil, err
+	}
+	m := &stdMap{
+		filename: filename,
+		opts:     *o,
+		state:    s,
+		Data:     s.data,
+	}
+	return m, err
+}
+
+// loadStdState opens filename and loads its lookup table. If the file does
+// not exist then an empty state is returned along with ErrNotExist.
+func loadStdState(filename string, o *options) (*stdState, error) {
+	s := &stdState{
+		filename: filename,
+		start:    headerSize,
+		offsets:  make(map[uint64]int64),
+		shiftkey: o.shift,
+		index:    o.index,
+		cache:    newCache(o),
+		refs:     1,
+	}
+
+	// finish any interrupted in-place commit first
+	err := replayLockedJournal(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// hold a shared lock so that the file cannot be modified while loading
+	l, err := lockShared(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+
 	f, err := os.Open(filename)
-	if err == nil {
-		var x uint32
-		err = binary.Read(f, binary.LittleEndian, &x)
-		if err != nil {
-			panic(err)
-		}
-		if x != MAGIC {
-			panic("this is not an 8sm file (magic invalid)")
-		}
-		// read in size of custom data section
-		err = binary.Read(f, binary.LittleEndian, &x)
-		if err != nil {
-			panic(err)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, fmt.Errorf("eightsetmap: %s: %w", filename, ErrNotExist)
 		}
-		if x > 0 {
-			cdata = make([]byte, x)
-			n, err := f.Read(cdata)
-			if err != nil {
-				panic(err)
-			}
-			if n != int(x) {
-				panic("did not fully read custom data")
-			}
+		return nil, err
+	}
+	err = s.load(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.f = f
+	return s, nil
+}
+
+// load reads the header and lookup table from f.
+func (s *stdState) load(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	s.info = info
+	s.size = info.Size()
+	s.tbl = f
+
+	h, err := readHeader(f)
+	if err != nil {
+		return loadError(s.filename, err)
+	}
+	s.data = h.Data
+	s.flags = h.Flags
+	s.gen = h.Generation
+	s.version = h.Version
+	s.start = int(h.TableOffset)
+	s.nkeys = h.NumKeys
+
+	if s.index && h.Version >= 2 {
+		// the table is always sorted, so it can be searched on disk
+		if h.TableOffset+int64(h.NumKeys)*16 > s.size {
+			return loadError(s.filename, ErrTruncated)
 		}
+		s.offsets = nil
+		s.mapTable(f)
+		return nil
+	}
+	// legacy tables may not be sorted
+	s.index = false
 
-		var i, n, key, lastkey uint64
-		var o int64
-		// number of offsets
-		err = binary.Read(f, binary.LittleEndian, &n)
+	if s.shiftkey == 0 {
+		s.offsets = make(map[uint64]int64, h.NumKeys)
+	}
+
+	// read the table in large chunks, since a read call per entry is far too
+	// slow for tables with billions of keys
+	const chunk = 1 << 16
+	buf := make([]byte, chunk*16)
+	var lastkey uint64
+	for i := uint64(0); i < h.NumKeys; {
+		c := h.NumKeys - i
+		if c > chunk {
+			c = chunk
+		}
+		b := buf[:c*16]
+		_, err = f.ReadAt(b, h.TableOffset+int64(i)*16)
 		if err != nil {
-			panic(err)
+			return loadError(s.filename, err)
 		}
-		for i = 0; i < n; i++ {
-			// uint64 key
-			err = binary.Read(f, binary.LittleEndian, &key)
-			if err != nil {
-				panic(err)
-			}
 
-			// int64 offset
-			err = binary.Read(f, binary.LittleEndian, &o)
-			if err != nil {
-				panic(err)
+		for ; len(b) > 0; b, i = b[16:], i+1 {
+			key := binary.LittleEndian.Uint64(b)
+			off := int64(binary.LittleEndian.Uint64(b[8:]))
+
+			if off == 0 {
+				// key was deleted by an in-place commit
+				s.ndeleted++
 			}
 
-			if shift != 0 {
+			if s.shiftkey != 0 {
 				if key < lastkey {
-					panic("keys are not sorted! cannot use shift until repacked")
+					return fmt.Errorf("eightsetmap: %s: %w", s.filename, ErrUnsorted)
 				}
+				lastkey = key
 
-				key >>= shift
-				if _, exists := offs[key]; !exists {
+				key >>= s.shiftkey
+				if _, exists := s.offsets[key]; !exists {
 					// gets the first table index, not the actual offset!
-					offs[key] = int64(i)
+					s.offsets[key] = int64(i)
 				}
 			} else {
-				offs[key] = o
+				if i > 0 && key <= lastkey {
+					s.unsorted = true
+				}
+				lastkey = key
+				if off != 0 {
+					s.offsets[key] = off
+				}
 			}
-			lastkey = key
 		}
-		f.Close()
 	}
 
-	c, _ := lru.New(DefaultCacheSize) // err always nil
-	return &stdMap{
-		filename: filename,
-		start:    16 + len(cdata),
-		offsets:  offs,
-		shiftkey: shift,
-		cache:    c,
+	return nil
+}
 
-		Data: cdata,
+// acquire returns the current state with a reference held for the caller, or
+// nil if the map is closed. The reference must be released when done.
+func (m *stdMap) acquire() *stdState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil
 	}
+	atomic.AddInt32(&m.state.refs, 1)
+	return m.state
+}
+
+// publish makes s the current state, and releases the previous one.
+func (m *stdMap) publish(s *stdState) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		s.release()
+		return ErrClosed
+	}
+	old := m.state
+	m.state = s
+	m.Data = s.data
+	m.stats.add(old.cache.Stats())
+	m.mu.Unlock()
+	old.release()
+	return nil
+}
+
+// drain waits up to timeout for calls in progress to release the state,
+// until only the current state and the caller hold references. It returns
+// false if they did not finish in time or a snapshot is using the state. The
+// map must be locked so that no new calls can start.
+func (s *stdState) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	wait := 10 * time.Microsecond
+	for atomic.LoadInt32(&s.snapshots) == 0 {
+		if atomic.LoadInt32(&s.refs) == 2 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(wait)
+		if wait < time.Millisecond {
+			wait *= 2
+		}
+	}
+	return false
+}
+
+// release drops a reference to the state, closing the backing file when the
+// state is no longer in use.
+func (s *stdState) release() error {
+	if atomic.AddInt32(&s.refs, -1) != 0 {
+		return nil
+	}
+	s.cache.Purge()
+	if s.tableMap != nil {
+		s.tableMap.UnsafeUnmap()
+		s.tableMap = nil
+	}
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// loadError wraps short reads as ErrTruncated, other errors are passed through.
+func loadError(filename string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	return fmt.Errorf("eightsetmap: %s: %w", filename, err)
 }
 
 // Get returns a slice of values for the given key.
 func (m *stdMap) Get(key uint64) ([]uint64, bool) {
-	if val, ok := m.cache.Get(key); ok {
-		v, ok := val.([]uint64)
-		return v, ok
+	s := m.acquire()
+	if s == nil {
+		return nil, false
 	}
-	return m.getFromBacking(key)
+	defer s.release()
+	return s.Get(key)
 }
 
 // GetSet returns a set of values for the given key.
 func (m *stdMap) GetSet(key uint64) (map[uint64]struct{}, bool) {
-	vals, ok := m.Get(key)
-	if !ok {
+	s := m.acquire()
+	if s == nil {
 		return nil, false
 	}
-	v := make(map[uint64]struct{}, len(vals))
-	for _, val := range vals {
-		v[val] = struct{}{}
-	}
-	return v, true
+	defer s.release()
+	return s.GetSet(key)
 }
 
 // GetWithExtra returns a slice of values for the given key, and calls the "extra" func
 // for any additional data stored within the lookup table.
 func (m *stdMap) GetWithExtra(key uint64, extra func(n int, r io.Reader)) ([]uint64, bool) {
-	return m.getWithExtraFromBacking(key, extra)
+	s := m.acquire()
+	if s == nil {
+		return nil, false
+	}
+	defer s.release()
+	return s.getWithExtraFromBacking(key, extra)
+}
+
+// GetBitmap returns the set of values for the given key if it is stored as a
+// bitmap container. Bitmaps are read directly and are not cached.
+func (m *stdMap) GetBitmap(key uint64) (Bitmap, bool) {
+	s := m.acquire()
+	if s == nil {
+		return Bitmap{}, false
+	}
+	defer s.release()
+	return s.GetBitmap(key)
+}
+
+// GetSize gets the size of the set of values for the given key
+func (m *stdMap) GetSize(key uint64) (uint32, bool) {
+	s := m.acquire()
+	if s == nil {
+		return 0, false
+	}
+	defer s.release()
+	return s.GetSize(key)
+}
+
+// GetCapacity gets the capacity reserved for the set of values for the given key
+func (m *stdMap) GetCapacity(key uint64) (uint32, bool) {
+	s := m.acquire()
+	if s == nil {
+		return 0, false
+	}
+	defer s.release()
+	return s.GetCapacity(key)
 }
 
 // EachKey calls eachFunc for every key in the map until a non-nil error is returned.
 func (m *stdMap) EachKey(eachFunc func(uint64) error) error {
-	if m.shiftkey > 0 {
-		return fmt.Errorf("not yet implemented")
+	s := m.acquire()
+	if s == nil {
+		return ErrClosed
+	}
+	defer s.release()
+	return s.EachKey(eachFunc)
+}
+
+// EachKeySorted calls eachFunc for every key in the map in ascending order
+// until a non-nil error is returned.
+func (m *stdMap) EachKeySorted(eachFunc func(uint64) error) error {
+	s := m.acquire()
+	if s == nil {
+		return ErrClosed
+	}
+	defer s.release()
+	return s.EachKeySorted(eachFunc)
+}
+
+// EachKeyReverse calls eachFunc for every key in the map in descending order
+// until a non-nil error is returned.
+func (m *stdMap) EachKeyReverse(eachFunc func(uint64) error) error {
+	s := m.acquire()
+	if s == nil {
+		return ErrClosed
+	}
+	defer s.release()
+	return s.EachKeyReverse(eachFunc)
+}
+
+// EachKeyInRange calls eachFunc in ascending order for every key in the map
+// where lo <= key <= hi, until a non-nil error is returned.
+func (m *stdMap) EachKeyInRange(lo, hi uint64, eachFunc func(uint64) error) error {
+	s := m.acquire()
+	if s == nil {
+		return ErrClosed
+	}
+	defer s.release()
+	return s.EachKeyInRange(lo, hi, eachFunc)
+}
+
+// EachEntry calls eachFunc with every key and its set of values, reading the
+// backing file sequentially in file order until a non-nil error is returned.
+// Values are not cached, and the vals slice is reused between calls so it
+// must be copied if it is retained after eachFunc returns.
+func (m *stdMap) EachEntry(eachFunc func(key uint64, vals []uint64) error) error {
+	s := m.acquire()
+	if s == nil {
+		return ErrClosed
 	}
-	for k := range m.offsets {
+	defer s.release()
+	return s.EachEntry(eachFunc)
+}
+
+// Close releases the backing file and purges the cache. Calls already in
+// progress finish before the file is closed.
+func (m *stdMap) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	s := m.state
+	if m.snapshot {
+		atomic.AddInt32(&s.snapshots, -1)
+	}
+	m.stats.add(s.cache.Stats())
+	if m.stop != nil {
+		close(m.stop)
+	}
+	m.mu.Unlock()
+	return s.release()
+}
+
+// Get returns a slice of values for the given key.
+func (s *stdState) Get(key uint64) ([]uint64, bool) {
+	if vals, ok := s.cache.Get(key); ok {
+		return vals, true
+	}
+	return s.getFromBacking(key)
+}
+
+// GetSet returns a set of values for the given key.
+func (s *stdState) GetSet(key uint64) (map[uint64]struct{}, bool) {
+	vals, ok := s.Get(key)
+	if !ok {
+		return nil, false
+	}
+	v := make(map[uint64]struct{}, len(vals))
+	for _, val := range vals {
+		v[val] = struct{}{}
+	}
+	return v, true
+}
+
+// EachKey calls eachFunc for every key in the map until a non-nil error is returned.
+func (s *stdState) EachKey(eachFunc func(uint64) error) error {
+	if s.shiftkey > 0 || s.index {
+		// offsets only contains shifted keys, so walk the lookup table instead
+		return s.EachKeySorted(eachFunc)
+	}
+	for k := range s.offsets {
 		err := eachFunc(k)
 		if err != nil {
 			return err
@@ -190,3 +612,47 @@ func (m *stdMap) EachKey(eachFunc func(uint64) error) error {
 	}
 	return nil
 }
+
+// hasKey returns true if the key is present in the backing file.
+func (s *stdState) hasKey(key uint64) bool {
+	if s.shiftkey == 0 && !s.index {
+		_, ok := s.offsets[key]
+		return ok
+	}
+	_, _, ok := s.backingOffset(key)
+	return ok
+}
+
+// EachKeySorted calls eachFunc for every key in the map in ascending order
+// until a non-nil error is returned.
+func (s *stdState) EachKeySorted(eachFunc func(uint64) error) error {
+	if s.unsorted {
+		return eachKeyIn(s.sortedKeys(), 0, math.MaxUint64, false, eachFunc)
+	}
+	return s.table().each(0, func(key uint64, offs int64) error {
+		return eachFunc(key)
+	})
+}
+
+// EachKeyReverse calls eachFunc for every key in the map in descending order
+// until a non-nil error is returned.
+func (s *stdState) EachKeyReverse(eachFunc func(uint64) error) error {
+	if s.unsorted {
+		return eachKeyIn(s.sortedKeys(), 0, math.MaxUint64, true, eachFunc)
+	}
+	t := s.table()
+	return t.eachReverse(t.n, func(key uint64, offs int64) error {
+		return eachFunc(key)
+	})
+}
+
+// EachKeyInRange calls eachFunc in ascending order for every key in the map
+// where lo <= key <= hi, until a non-nil error is returned.
+func (s *stdState) EachKeyInRange(lo, hi uint64, eachFunc func(uint64) error) error {
+	if s.unsorted {
+		return eachKeyIn(s.sortedKeys(), lo, hi, false, eachFunc)
+	}
+	return s.table().eachInRange(lo, hi, func(key uint64, offs int64) error {
+		return eachFunc(key)
+	})
+}
@@ -1,9 +1,16 @@
 package eightsetmap
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
+	"sort"
+	"sync"
 	"testing"
 )
 
@@ -117,10 +124,94 @@ func TestSimple(t *testing.T) {
 	}
 
 	os.Remove("testing.8sm")
+	os.Remove(lockName("testing.8sm"))
+}
+
+func TestConcurrent(t *testing.T) {
+	os.Remove("concurrent_testing.8sm")
+	m := New("concurrent_testing.8sm")
+	mm := Mutate(m, false)
+	for k := uint64(0); k < 500; k++ {
+		mk := mm.OpenKey(k)
+		for i := uint64(0); i < k%50; i++ {
+			mk.Put(k + i)
+		}
+		mk.Sync()
+	}
+	err := mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	for _, shift := range []uint64{0, 3} {
+		m = NewShifted("concurrent_testing.8sm", shift)
+		errs := make(chan error, 16)
+		var wg sync.WaitGroup
+		for g := 0; g < 16; g++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed))
+				for i := 0; i < 2000; i++ {
+					k := uint64(r.Intn(600))
+					var vals []uint64
+					var found bool
+					switch i % 4 {
+					case 0:
+						vals, found = m.Get(k)
+					case 1:
+						vals, found = m.GetWithExtra(k, func(n int, r io.Reader) {})
+					case 2:
+						var sz uint32
+						sz, found = m.GetSize(k)
+						vals = make([]uint64, sz)
+					case 3:
+						var c uint32
+						c, found = m.GetCapacity(k)
+						if found && c < uint32(k%50) {
+							errs <- fmt.Errorf("capacity %d too small for key %d", c, k)
+							return
+						}
+						continue
+					}
+					if found != (k < 500) {
+						errs <- fmt.Errorf("key %d found=%v", k, found)
+						return
+					}
+					if !found {
+						continue
+					}
+					if uint64(len(vals)) != k%50 {
+						errs <- fmt.Errorf("key %d has %d values, expected %d", k, len(vals), k%50)
+						return
+					}
+					if i%4 == 2 {
+						continue
+					}
+					for j, v := range vals {
+						if v != k+uint64(j) {
+							errs <- fmt.Errorf("key %d value %d is %d, expected %d", k, j, v, k+uint64(j))
+							return
+						}
+					}
+				}
+			}(int64(g))
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("shift=%d: %s", shift, err)
+		}
+		m.Close()
+	}
+
+	os.Remove("concurrent_testing.8sm")
+	os.Remove(lockName("concurrent_testing.8sm"))
 }
 
 func TestFibo(t *testing.T) {
 	os.Remove("fibo_testing.8sm")
+	defer os.Remove(lockName("fibo_testing.8sm"))
 	m := New("fibo_testing.8sm")
 	mm := Mutate(m, false)
 
@@ -295,10 +386,160 @@ func TestFibo(t *testing.T) {
 			t.Fatal("should not have found key for", f)
 		}
 	}
+
+	// walk all keys in the shifted map
+	seen := make(map[uint64]struct{})
+	var lastkey uint64
+	err = m2.EachKey(func(k uint64) error {
+		if len(seen) > 0 && k <= lastkey {
+			return fmt.Errorf("key %d walked after %d", k, lastkey)
+		}
+		seen[k] = struct{}{}
+		lastkey = k
+		return nil
+	})
+	if err != nil {
+		t.Fatal("unable to walk keys when shifted", err)
+	}
+	if len(seen) != len(fibs)+len(fibs2) {
+		t.Fatal("walked", len(seen), "keys instead of", len(fibs)+len(fibs2), "when shifted")
+	}
+	for _, f := range append(fibs, fibs2...) {
+		if _, ok := seen[f]; !ok {
+			t.Fatal("did not walk", f, "when shifted")
+		}
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	os.Remove("open_testing.8sm")
+	defer os.Remove("open_testing.8sm")
+	defer os.Remove(lockName("open_testing.8sm"))
+
+	w, err := NewAppendWriter("open_testing.8sm")
+	if err != nil {
+		b.Fatal(err)
+	}
+	w.SetPacker(TightPacker)
+	for k := uint64(0); k < 1000000; k++ {
+		err = w.Append(k*3, []uint64{k})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	m, err := w.Finish()
+	if err != nil {
+		b.Fatal(err)
+	}
+	m.Close()
+
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"shifted", []Option{WithShift(4)}},
+		{"diskindex", []Option{WithDiskIndex()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m, err := Open("open_testing.8sm", bc.opts...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				m.Close()
+			}
+		})
+	}
+}
+
+func TestShiftedCommit(t *testing.T) {
+	os.Remove("shifted_testing.8sm")
+	m := New("shifted_testing.8sm")
+	mm := Mutate(m, false)
+	for k := uint64(0); k < 100; k += 2 {
+		mk := mm.OpenKey(k)
+		mk.Put(k)
+		mk.Sync()
+	}
+	err := mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	m = NewShifted("shifted_testing.8sm", 2)
+	mm = Mutate(m, false)
+	// odd keys are new, every 10th key gets a new value
+	for k := uint64(1); k < 120; k += 2 {
+		mk := mm.OpenKey(k)
+		mk.Put(k)
+		mk.Sync()
+	}
+	for k := uint64(0); k < 100; k += 10 {
+		mk := mm.OpenKey(k)
+		mk.Put(k + 1)
+		mk.Sync()
+	}
+
+	chk := func(msg string, m Map) {
+		for k := uint64(0); k < 130; k++ {
+			vals, found := m.Get(k)
+			if found != (k < 100 || (k < 120 && k%2 == 1)) {
+				t.Fatalf("%s: key %d found=%v", msg, k, found)
+			}
+			if !found {
+				continue
+			}
+			n := 1
+			if k%10 == 0 {
+				n = 2
+			}
+			if len(vals) != n || vals[0] != k {
+				t.Fatalf("%s: key %d has values %v", msg, k, vals)
+			}
+		}
+		n := 0
+		err := m.EachKey(func(uint64) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: unable to walk keys: %s", msg, err)
+		}
+		if n != 110 {
+			t.Fatalf("%s: walked %d keys instead of 110", msg, n)
+		}
+	}
+
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit shifted changes", err)
+	}
+	chk("after shifted commit", m)
+	chk("after reopening", New("shifted_testing.8sm"))
+	chk("after reopening shifted", NewShifted("shifted_testing.8sm", 3))
+
+	// grow an existing key in place
+	mm = Mutate(m, false)
+	mk := mm.OpenKey(50)
+	mk.Put(52)
+	mk.Sync()
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit shifted changes in place", err)
+	}
+	vals, found := NewShifted("shifted_testing.8sm", 3).Get(50)
+	if !found || len(vals) != 3 {
+		t.Fatal("did not find 3 values for key 50 after in-place commit", vals)
+	}
+
+	os.Remove("shifted_testing.8sm")
+	os.Remove(lockName("shifted_testing.8sm"))
 }
 
 func TestInplace(t *testing.T) {
 	os.Remove("inplace_testing.8sm")
+	defer os.Remove(lockName("inplace_testing.8sm"))
 	m := New("inplace_testing.8sm")
 	mm := Mutate(m, false)
 
@@ -533,3 +774,472 @@ func TestInplace(t *testing.T) {
 		t.Fatalf("size did not change. should have grown (new:%d != old:%d)", sz2, sz)
 	}
 }
+
+func TestOpenErrors(t *testing.T) {
+	os.Remove("errors_testing.8sm")
+	_, err := Open("errors_testing.8sm")
+	if !errors.Is(err, ErrNotExist) {
+		t.Fatal("expected ErrNotExist for missing file, got", err)
+	}
+	_, err = OpenMMap("errors_testing.8sm")
+	if !errors.Is(err, ErrNotExist) {
+		t.Fatal("expected ErrNotExist for missing file (mmap), got", err)
+	}
+
+	err = ioutil.WriteFile("errors_testing.8sm", []byte("not an 8sm file"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open("errors_testing.8sm")
+	if !errors.Is(err, ErrBadMagic) {
+		t.Fatal("expected ErrBadMagic, got", err)
+	}
+
+	os.Remove("errors_testing.8sm")
+	m := New("errors_testing.8sm")
+	mm := Mutate(m, false)
+	for _, k := range []uint64{1, 2, 3, 4} {
+		mk := mm.OpenKey(k)
+		mk.Put(k * 10)
+		mk.Sync()
+	}
+	err = mm.Commit(true)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	m, err = Open("errors_testing.8sm", WithShift(1))
+	if err != nil {
+		t.Fatal("unable to open valid file", err)
+	}
+	vals, ok := m.Get(3)
+	if !ok || len(vals) != 1 || vals[0] != 30 {
+		t.Fatal("did not find expected values for key 3 after Open")
+	}
+
+	data, err := ioutil.ReadFile("errors_testing.8sm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("errors_testing.8sm", data[:30], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open("errors_testing.8sm")
+	if !errors.Is(err, ErrTruncated) {
+		t.Fatal("expected ErrTruncated, got", err)
+	}
+
+	// swap the first two keys in the lookup table
+	start := m.(*stdMap).state.start
+	copy(data[start:start+8], []byte{2, 0, 0, 0, 0, 0, 0, 0})
+	copy(data[start+16:start+24], []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	err = ioutil.WriteFile("errors_testing.8sm", data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open("errors_testing.8sm", WithShift(1))
+	if !errors.Is(err, ErrUnsorted) {
+		t.Fatal("expected ErrUnsorted, got", err)
+	}
+
+	os.Remove("errors_testing.8sm")
+	os.Remove(lockName("errors_testing.8sm"))
+}
+
+func TestClose(t *testing.T) {
+	os.Remove("close_testing.8sm")
+	m := New("close_testing.8sm")
+	mm := Mutate(m, false)
+	for _, k := range []uint64{1, 2, 3} {
+		mk := mm.OpenKey(k)
+		mk.Put(k * 10)
+		mk.Sync()
+	}
+	err := mm.Commit(true)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	m = New("close_testing.8sm")
+	mp := MMap(m)
+	if _, ok := m.Get(2); !ok {
+		t.Fatal("did not find 2 before closing")
+	}
+	if _, ok := mp.Get(2); !ok {
+		t.Fatal("did not find 2 before closing (mmap)")
+	}
+
+	for _, x := range []Map{m, mp} {
+		err = x.Close()
+		if err != nil {
+			t.Fatal("unable to close map", err)
+		}
+		if _, ok := x.Get(2); ok {
+			t.Fatal("found 2 after closing")
+		}
+		if _, ok := x.GetSize(2); ok {
+			t.Fatal("found size of 2 after closing")
+		}
+		err = x.EachKey(func(uint64) error { return nil })
+		if err != ErrClosed {
+			t.Fatal("expected ErrClosed from EachKey after closing, got", err)
+		}
+		err = x.Close()
+		if err != nil {
+			t.Fatal("second close should be a no-op", err)
+		}
+	}
+
+	mm = Mutate(m, false)
+	mk := mm.OpenKey(4)
+	mk.Put(40)
+	mk.Sync()
+	err = mm.Commit(true)
+	if err != ErrClosed {
+		t.Fatal("expected ErrClosed when committing to a closed map, got", err)
+	}
+
+	os.Remove("close_testing.8sm")
+	os.Remove(lockName("close_testing.8sm"))
+}
+
+func TestSortedIteration(t *testing.T) {
+	os.Remove("sorted_testing.8sm")
+	m := New("sorted_testing.8sm")
+	mm := Mutate(m, false)
+	keys := make([]uint64, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		k := uint64(rand.Intn(1000000))
+		mk := mm.OpenKey(k)
+		mk.Put(k)
+		mk.Sync()
+	}
+	err := mm.Commit(true)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	for k := range mm.Map.state.offsets {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	chk := func(msg string, got, ex []uint64) {
+		if len(got) != len(ex) {
+			t.Fatalf("%s: walked %d keys, expected %d", msg, len(got), len(ex))
+		}
+		for i, k := range got {
+			if k != ex[i] {
+				t.Fatalf("%s: key[%d]=%d, expected %d", msg, i, k, ex[i])
+			}
+		}
+	}
+
+	for _, x := range []Map{New("sorted_testing.8sm"), NewShifted("sorted_testing.8sm", 4), MMap(m)} {
+		var got []uint64
+		err = x.EachKeySorted(func(k uint64) error {
+			got = append(got, k)
+			return nil
+		})
+		if err != nil {
+			t.Fatal("unable to walk sorted keys", err)
+		}
+		chk("sorted", got, keys)
+
+		got = got[:0]
+		err = x.EachKeyReverse(func(k uint64) error {
+			got = append(got, k)
+			return nil
+		})
+		if err != nil {
+			t.Fatal("unable to walk reversed keys", err)
+		}
+		rev := make([]uint64, len(keys))
+		for i, k := range keys {
+			rev[len(keys)-1-i] = k
+		}
+		chk("reversed", got, rev)
+
+		// ranges are inclusive on both ends
+		lo, hi := keys[100], keys[199]
+		got = got[:0]
+		err = x.EachKeyInRange(lo, hi, func(k uint64) error {
+			got = append(got, k)
+			return nil
+		})
+		if err != nil {
+			t.Fatal("unable to walk key range", err)
+		}
+		chk("range", got, keys[100:200])
+
+		got = got[:0]
+		err = x.EachKeyInRange(lo+1, hi-1, func(k uint64) error {
+			got = append(got, k)
+			return nil
+		})
+		if err != nil {
+			t.Fatal("unable to walk key range", err)
+		}
+		chk("exclusive range", got, keys[101:199])
+
+		got = got[:0]
+		err = x.EachKeyInRange(hi, lo, func(k uint64) error {
+			got = append(got, k)
+			return nil
+		})
+		if err != nil {
+			t.Fatal("unable to walk empty key range", err)
+		}
+		chk("empty range", got, nil)
+
+		// resume from a checkpoint
+		stop := errors.New("stop")
+		got = got[:0]
+		err = x.EachKeySorted(func(k uint64) error {
+			if len(got) == 10 {
+				return stop
+			}
+			got = append(got, k)
+			return nil
+		})
+		if err != stop {
+			t.Fatal("expected early stop error, got", err)
+		}
+		err = x.EachKeyInRange(got[len(got)-1]+1, ^uint64(0), func(k uint64) error {
+			got = append(got, k)
+			return nil
+		})
+		if err != nil {
+			t.Fatal("unable to resume walk", err)
+		}
+		chk("resumed", got, keys)
+	}
+
+	os.Remove("sorted_testing.8sm")
+	os.Remove(lockName("sorted_testing.8sm"))
+}
+
+func TestEachEntry(t *testing.T) {
+	os.Remove("entry_testing.8sm")
+	m := New("entry_testing.8sm")
+	mm := Mutate(m, false)
+	for k := uint64(0); k < 300; k += 3 {
+		mk := mm.OpenKey(k)
+		for i := uint64(0); i < k; i++ {
+			mk.Put(i * k)
+		}
+		mk.Sync()
+	}
+	err := mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	for _, x := range []Map{New("entry_testing.8sm"), NewShifted("entry_testing.8sm", 2), MMap(m)} {
+		n := 0
+		lastkey := uint64(0)
+		err = x.EachEntry(func(k uint64, vals []uint64) error {
+			if n > 0 && k <= lastkey {
+				return fmt.Errorf("key %d walked after %d", k, lastkey)
+			}
+			lastkey = k
+			n++
+			if uint64(len(vals)) != k {
+				return fmt.Errorf("key %d has %d values", k, len(vals))
+			}
+			for i, v := range vals {
+				if v != uint64(i)*k {
+					return fmt.Errorf("key %d value[%d]=%d, expected %d", k, i, v, uint64(i)*k)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal("unable to walk entries", err)
+		}
+		if n != 100 {
+			t.Fatal("walked", n, "entries instead of 100")
+		}
+		if sm, ok := x.(*stdMap); ok && sm.state.cache.Len() != 0 {
+			t.Fatal("walking entries should not fill the cache")
+		}
+	}
+
+	os.Remove("entry_testing.8sm")
+	os.Remove(lockName("entry_testing.8sm"))
+}
+
+func TestDeleteKey(t *testing.T) {
+	os.Remove("delete_testing.8sm")
+	m := New("delete_testing.8sm")
+	mm := Mutate(m, false)
+	for k := uint64(0); k < 20; k++ {
+		mk := mm.OpenKey(k)
+		mk.Put(k)
+		mk.Sync()
+	}
+	err := mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	gone := make(map[uint64]bool)
+	chk := func(msg string, m Map) {
+		for k := uint64(0); k < 20; k++ {
+			vals, found := m.Get(k)
+			if found == gone[k] {
+				t.Fatalf("%s: key %d found=%v", msg, k, found)
+			}
+			if found && (len(vals) != 1 || vals[0] != k) {
+				t.Fatalf("%s: key %d has values %v", msg, k, vals)
+			}
+		}
+		for _, walk := range []func(func(uint64) error) error{m.EachKey, m.EachKeySorted} {
+			n := 0
+			err := walk(func(k uint64) error {
+				if gone[k] {
+					return fmt.Errorf("walked deleted key %d", k)
+				}
+				n++
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("%s: %s", msg, err)
+			}
+			if n != 20-len(gone) {
+				t.Fatalf("%s: walked %d keys instead of %d", msg, n, 20-len(gone))
+			}
+		}
+	}
+
+	// delete in-place
+	mm = Mutate(m, false)
+	for _, k := range []uint64{0, 5, 6, 19, 42} {
+		mm.DeleteKey(k)
+		if k < 20 {
+			gone[k] = true
+		}
+	}
+	if _, found := mm.Get(5); found {
+		t.Fatal("found 5 after deleting")
+	}
+	info, _ := os.Stat("delete_testing.8sm")
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit deletes", err)
+	}
+	info2, _ := os.Stat("delete_testing.8sm")
+	if info.Size() != info2.Size() {
+		t.Fatal("size changed, should have deleted in-place")
+	}
+	chk("after in-place delete", m)
+	chk("after reopening", New("delete_testing.8sm"))
+	chk("after reopening shifted", NewShifted("delete_testing.8sm", 2))
+	chk("after reopening mmap", MMap(New("delete_testing.8sm")))
+
+	// delete with a full rewrite, and bring back a previously deleted key
+	m = NewShifted("delete_testing.8sm", 2)
+	mm = Mutate(m, false)
+	mm.DeleteKey(10)
+	gone[10] = true
+	mk := mm.OpenKey(5)
+	mk.Put(5)
+	mk.Sync()
+	delete(gone, 5)
+	// an open key is emptied by the delete, but can still be used
+	mk = mm.OpenKey(7)
+	mm.DeleteKey(7)
+	if _, found := mm.Get(7); found {
+		t.Fatal("found 7 after deleting")
+	}
+	mk.Put(7)
+	mk.Sync()
+	err = mm.Commit(true)
+	if err != nil {
+		t.Fatal("unable to commit deletes", err)
+	}
+	info3, _ := os.Stat("delete_testing.8sm")
+	if info3.Size() >= info2.Size() {
+		t.Fatal("size did not shrink after packed commit")
+	}
+	chk("after rewrite delete", m)
+	chk("after reopening", New("delete_testing.8sm"))
+	chk("after reopening shifted", NewShifted("delete_testing.8sm", 2))
+
+	os.Remove("delete_testing.8sm")
+	os.Remove(lockName("delete_testing.8sm"))
+}
+
+func TestCommitResult(t *testing.T) {
+	os.Remove("result_testing.8sm")
+	m := New("result_testing.8sm")
+	mm := Mutate(m, false)
+	for k := uint64(0); k < 10; k++ {
+		mk := mm.OpenKey(k)
+		mk.Put(k)
+		mk.Sync()
+	}
+	res, err := mm.CommitWithResult(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	if res.InPlace || len(res.RewriteKeys) != 10 || res.BytesWritten == 0 {
+		t.Fatalf("unexpected result for a new map %+v", res)
+	}
+	info, _ := os.Stat("result_testing.8sm")
+	if res.BytesWritten != info.Size() {
+		t.Fatal("wrote", res.BytesWritten, "bytes but file is", info.Size())
+	}
+
+	mk := mm.OpenKey(3)
+	mk.Put(300)
+	mk.Sync()
+	res, err = mm.CommitWithResult(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	if !res.InPlace || len(res.RewriteKeys) != 0 || res.BytesWritten == 0 || res.BytesWritten > 64 {
+		t.Fatalf("unexpected result for an in-place commit %+v", res)
+	}
+
+	// a new key and a set over capacity force a rewrite, leaving the file untouched
+	before, _ := ioutil.ReadFile("result_testing.8sm")
+	mk = mm.OpenKey(5)
+	for i := uint64(0); i < uint64(DefaultCapacity); i++ {
+		mk.Put(1000 + i)
+	}
+	mk.Sync()
+	mk = mm.OpenKey(20)
+	mk.Put(1)
+	mk.Sync()
+	mk = mm.OpenKey(7)
+	mk.Put(1)
+	mk.Sync()
+	if err = mm.inplaceCommit(&CommitResult{}); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	after, _ := ioutil.ReadFile("result_testing.8sm")
+	if !bytes.Equal(before, after) {
+		t.Fatal("rejected in-place commit modified the file")
+	}
+	res, err = mm.CommitWithResult(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	if res.InPlace || len(res.RewriteKeys) != 2 || res.RewriteKeys[0] != 5 || res.RewriteKeys[1] != 20 || res.Reason == "" {
+		t.Fatalf("unexpected result for a rewrite %+v", res)
+	}
+	if vals, _ := New("result_testing.8sm").Get(7); len(vals) != 2 {
+		t.Fatal("key 7 not updated by the rewrite", vals)
+	}
+
+	res, err = mm.CommitWithResult(true)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	if res.InPlace || res.Reason == "" {
+		t.Fatalf("unexpected result for a packed commit %+v", res)
+	}
+
+	os.Remove("result_testing.8sm")
+	os.Remove(lockName("result_testing.8sm"))
+}
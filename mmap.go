@@ -3,22 +3,122 @@ package eightsetmap
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/tysontate/gommap"
 )
 
 // memMap represents a mmap'd view of the on-disk Map format.
+//
+// Like a stdMap, each call uses the region mapped for one generation of the
+// file, which is replaced by Reload. Slices returned by the map point into the
+// mapped regions, which stay mapped until the map is closed, so they must not
+// be used after that unless they were returned by a Snapshot which is still
+// open. While the file is mapped, commits from a MutableMap in this process
+// rewrite it instead of modifying it in-place.
 type memMap struct {
-	// the raw data
+	filename string
+	opts     options
+	snapshot bool // pinned to one state, see Snapshot
+
+	mu     sync.RWMutex // guards state and closed
+	state  *memState
+	closed bool
+	stop   chan struct{} // closed to stop the watcher, if any
+
+	// regions of previously loaded generations, which stay mapped until the
+	// map is closed since slices returned by Get may still point into them
+	retired []*region
+}
+
+// region is a mapped file, which is unmapped once no memState or memMap uses
+// it any more.
+type region struct {
 	mmap gommap.MMap
+	info os.FileInfo
+	refs int32
+}
+
+// mapped holds the regions which are currently mapped in this process. Writes
+// to a mapped file would change slices already returned from it, so in-place
+// commits are not used for these files, see isMapped.
+var mapped = struct {
+	sync.Mutex
+	regions map[*region]struct{}
+}{regions: make(map[*region]struct{})}
+
+// newRegion registers x as the mapping of the file described by info.
+func newRegion(x gommap.MMap, info os.FileInfo) *region {
+	r := &region{mmap: x, info: info, refs: 1}
+	mapped.Lock()
+	mapped.regions[r] = struct{}{}
+	mapped.Unlock()
+	return r
+}
+
+// release drops a reference to the region, unmapping it when it is no longer
+// in use.
+func (r *region) release() error {
+	if atomic.AddInt32(&r.refs, -1) != 0 {
+		return nil
+	}
+	mapped.Lock()
+	delete(mapped.regions, r)
+	mapped.Unlock()
+	return r.mmap.UnsafeUnmap()
+}
+
+// isMapped returns true if the file described by info is mapped by any memMap
+// or snapshot in this process.
+func isMapped(info os.FileInfo) bool {
+	mapped.Lock()
+	defer mapped.Unlock()
+	for r := range mapped.regions {
+		if os.SameFile(r.info, info) {
+			return true
+		}
+	}
+	return false
+}
+
+// memState is the mapped region and sets of a memMap for one generation of
+// the file. The sets are dropped once the state is no longer in use.
+type memState struct {
+	// the raw data
+	mmap   gommap.MMap
+	region *region
+	info   os.FileInfo
 
 	// map to unsafe slices backed by the mmap above
 	nodes  map[uint64][]uint64
 	extras map[uint64][]byte
+
+	// decoded sets that are stored as bitmap containers
+	bitmaps map[uint64]Bitmap
+
+	// sorted lookup table within the mmap above
+	table tableReader
+
+	// feature flags and generation from the file header
+	flags uint64
+	gen   uint64
+
+	// lazy states decode sets on demand instead of filling nodes, extras and
+	// bitmaps, see WithLazyMMap. With a shift, offsets maps shifted keys to
+	// their first lookup table index.
+	lazy     bool
+	shiftkey uint64
+	unsorted bool // the legacy lookup table cannot be walked in key order
+	offsets  map[uint64]int64
+
+	refs int32 // calls and snapshots using the state, plus one while it is current
 }
 
 // unsafely cast a byte array to a uint64 array
@@ -31,56 +131,180 @@ func touint64(x []byte) []uint64 {
 	return xx
 }
 
+// MMap returns a memory-mapped view of the given Map, which must have been
+// created by New or NewShifted. It panics if the file cannot be mapped, see
+// OpenMMap for an error-returning alternative.
 func MMap(mp Map) Map {
 	m, ok := mp.(*stdMap)
-	if !ok {
+	if !ok || m.snapshot {
 		panic("cannot mmap this type of map")
 	}
-	f, err := os.Open(m.filename)
+	s, err := mmapFile(m.filename, &m.opts)
 	if err != nil {
 		panic(err)
 	}
+	return &memMap{filename: m.filename, opts: m.opts, state: s}
+}
+
+// OpenMMap returns a memory-mapped Map backed by the data in filename. Errors
+// are the same as those returned by Open.
+func OpenMMap(filename string, opts ...Option) (Map, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	s, err := mmapFile(filename, o)
+	if err != nil {
+		return nil, err
+	}
+	mm := &memMap{filename: filename, opts: *o, state: s}
+	if o.watch > 0 {
+		mm.stop = make(chan struct{})
+		go watchFile(filename, o.watch, mm.stop, mm.loadedInfo, mm.Reload)
+	}
+	return mm, nil
+}
+
+// mmapFile maps filename into memory and loads its sets.
+func mmapFile(filename string, o *options) (*memState, error) {
+	err := replayLockedJournal(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// hold a shared lock so that the file cannot be modified in-place while
+	// the mapped sets are loaded
+	l, err := lockShared(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("eightsetmap: %s: %w", filename, ErrNotExist)
+		}
+		return nil, err
+	}
+	defer f.Close()
 	info, err := f.Stat()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	x, err := gommap.MapRegion(f.Fd(), 0, info.Size(), gommap.PROT_READ, gommap.MAP_SHARED)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	s, err := loadMemState(x, o)
+	if err == nil && o.advice != AdviceNormal {
+		err = x.Advise(o.advice.flags())
 	}
+	if err != nil {
+		x.UnsafeUnmap()
+		return nil, loadError(filename, err)
+	}
+	s.info = info
+	s.region = newRegion(x, info)
+	return s, nil
+}
 
-	mm := &memMap{
-		mmap:   x,
-		nodes:  make(map[uint64][]uint64),
-		extras: make(map[uint64][]byte),
+// loadMemState builds the sets for every key in the mapped file x, unless it
+// is lazily loaded. The header and lookup table are read from x itself, since
+// the file may have been replaced since the map was opened.
+func loadMemState(x gommap.MMap, o *options) (*memState, error) {
+	h, err := readHeader(bytes.NewReader(x))
+	if err != nil {
+		return nil, err
+	}
+	if h.TableOffset+int64(h.NumKeys)*16 > int64(len(x)) {
+		return nil, ErrTruncated
 	}
 
-	for k, offs := range m.offsets {
+	mm := &memState{
+		refs:  1,
+		mmap:  x,
+		table: tableReader{r: bytes.NewReader(x), start: h.TableOffset, n: h.NumKeys},
+		flags: h.Flags,
+		gen:   h.Generation,
+	}
+	// legacy tables may not be sorted, and can only be searched if they are
+	// (shifted tables are checked while building the index)
+	if o.lazy && (h.Version >= 2 || o.shift > 0 || mm.sortedTable()) {
+		err = mm.loadLazy(o.shift)
+		if err != nil {
+			return nil, err
+		}
+		return mm, nil
+	}
+
+	mm.nodes = make(map[uint64][]uint64)
+	mm.extras = make(map[uint64][]byte)
+	mm.bitmaps = make(map[uint64]Bitmap)
+
+	var lastkey uint64
+	first := true
+	err = mm.table.each(0, func(k uint64, offs int64) error {
+		if !first && k <= lastkey {
+			mm.unsorted = true
+		}
+		first = false
+		lastkey = k
+		if offs < 0 || offs+8 > int64(len(x)) {
+			return ErrTruncated
+		}
 		caplen := binary.LittleEndian.Uint64(x[offs : offs+8])
 		offs += 8
-		offend1 := offs + int64(uint32(caplen)*8)
-		offend2 := offs + int64(uint32(caplen>>32)*8)
+		offend1 := offs + int64(uint32(caplen))*8
+		offend2 := offs + int64(blockCap(caplen))*8
+		if !validBlock(int64(len(x)), offs-8, caplen, h.Flags) {
+			return ErrTruncated
+		}
 
-		p1 := x[offs:offend1]
-		mm.nodes[k] = touint64(p1)
+		if caplen&bitmapBlock != 0 {
+			bm, n, err := decodeBitmap(x[offs:offend2])
+			if err != nil {
+				return err
+			}
+			mm.bitmaps[k] = bm
+			mm.nodes[k] = bm.Values(make([]uint64, 0, uint32(caplen)))
+			offend1 = offs + int64(n)
+		} else if h.Flags&FlagDeltaVarint != 0 {
+			// compressed sets are decoded up front, extras follow the encoded words
+			vals, n, err := decodeValues(nil, x[offs:offend2], caplen, h.Flags)
+			if err != nil {
+				return err
+			}
+			mm.nodes[k] = vals
+			offend1 = offs + int64(n)
+		} else {
+			mm.nodes[k] = touint64(x[offs:offend1])
+		}
 
 		if offend1 != offend2 {
 			mm.extras[k] = x[offend1:offend2]
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return mm
+	return mm, nil
 }
 
 // Get returns a slice of values for the given key.
-func (m *memMap) Get(key uint64) ([]uint64, bool) {
+func (m *memState) Get(key uint64) ([]uint64, bool) {
+	if m.lazy {
+		vals, _, ok := m.lazyGet(key)
+		return vals, ok
+	}
 	val, ok := m.nodes[key]
 	return val, ok
 }
 
 // GetSet returns a set of values for the given key.
-func (m *memMap) GetSet(key uint64) (map[uint64]struct{}, bool) {
+func (m *memState) GetSet(key uint64) (map[uint64]struct{}, bool) {
 	vals, ok := m.Get(key)
 	if !ok {
 		return nil, false
@@ -94,7 +318,14 @@ func (m *memMap) GetSet(key uint64) (map[uint64]struct{}, bool) {
 
 // GetWithExtra returns a slice of values for the given key, and calls the "extra" func
 // for any additional data stored within the lookup table.
-func (m *memMap) GetWithExtra(key uint64, extra func(n int, r io.Reader)) ([]uint64, bool) {
+func (m *memState) GetWithExtra(key uint64, extra func(n int, r io.Reader)) ([]uint64, bool) {
+	if m.lazy {
+		vals, b, ok := m.lazyGet(key)
+		if len(b) > 0 {
+			extra(len(b)/8, bytes.NewBuffer(b))
+		}
+		return vals, ok
+	}
 	if b, ok := m.extras[key]; ok {
 		buf := bytes.NewBuffer(b)
 		extra(len(b)/8, buf)
@@ -104,7 +335,10 @@ func (m *memMap) GetWithExtra(key uint64, extra func(n int, r io.Reader)) ([]uin
 }
 
 // EachKey calls eachFunc for every key in the map until a non-nil error is returned.
-func (m *memMap) EachKey(eachFunc func(uint64) error) error {
+func (m *memState) EachKey(eachFunc func(uint64) error) error {
+	if m.lazy {
+		return m.EachKeySorted(eachFunc)
+	}
 	for k := range m.nodes {
 		err := eachFunc(k)
 		if err != nil {
@@ -114,15 +348,274 @@ func (m *memMap) EachKey(eachFunc func(uint64) error) error {
 	return nil
 }
 
+// EachKeySorted calls eachFunc for every key in the map in ascending order
+// until a non-nil error is returned.
+func (m *memState) EachKeySorted(eachFunc func(uint64) error) error {
+	if m.unsorted {
+		return eachKeyIn(m.sortedKeys(), 0, math.MaxUint64, false, eachFunc)
+	}
+	return m.table.each(0, func(key uint64, offs int64) error {
+		return eachFunc(key)
+	})
+}
+
+// EachKeyReverse calls eachFunc for every key in the map in descending order
+// until a non-nil error is returned.
+func (m *memState) EachKeyReverse(eachFunc func(uint64) error) error {
+	if m.unsorted {
+		return eachKeyIn(m.sortedKeys(), 0, math.MaxUint64, true, eachFunc)
+	}
+	return m.table.eachReverse(m.table.n, func(key uint64, offs int64) error {
+		return eachFunc(key)
+	})
+}
+
+// EachKeyInRange calls eachFunc in ascending order for every key in the map
+// where lo <= key <= hi, until a non-nil error is returned.
+func (m *memState) EachKeyInRange(lo, hi uint64, eachFunc func(uint64) error) error {
+	if m.unsorted {
+		return eachKeyIn(m.sortedKeys(), lo, hi, false, eachFunc)
+	}
+	return m.table.eachInRange(lo, hi, func(key uint64, offs int64) error {
+		return eachFunc(key)
+	})
+}
+
+// EachEntry calls eachFunc with every key and its set of values in sorted key
+// order until a non-nil error is returned.
+func (m *memState) EachEntry(eachFunc func(key uint64, vals []uint64) error) error {
+	return m.table.each(0, func(key uint64, offs int64) error {
+		if offs < 0 || offs+8 > int64(len(m.mmap)) {
+			return ErrTruncated
+		}
+		caplen := binary.LittleEndian.Uint64(m.mmap[offs:])
+		if m.flags&FlagDeltaVarint != 0 || caplen&bitmapBlock != 0 {
+			if !validBlock(int64(len(m.mmap)), offs, caplen, m.flags) {
+				return ErrTruncated
+			}
+			vals, _, err := decodeValues(nil, m.mmap[offs+8:], caplen, m.flags)
+			if err != nil {
+				return err
+			}
+			return eachFunc(key, vals)
+		}
+		l := int64(uint32(caplen))
+		if offs+8+l*8 > int64(len(m.mmap)) {
+			return ErrTruncated
+		}
+		return eachFunc(key, touint64(m.mmap[offs+8:offs+8+l*8]))
+	})
+}
+
+// GetBitmap returns the set of values for the given key if it is stored as a
+// bitmap container.
+func (m *memState) GetBitmap(key uint64) (Bitmap, bool) {
+	if m.lazy {
+		return m.lazyBitmap(key)
+	}
+	bm, ok := m.bitmaps[key]
+	return bm, ok
+}
+
 // GetSize gets the size of the set of values for the given key
-func (m *memMap) GetSize(key uint64) (uint32, bool) {
+func (m *memState) GetSize(key uint64) (uint32, bool) {
+	if m.lazy {
+		caplen, _, ok := m.block(key)
+		return uint32(caplen), ok
+	}
 	val, ok := m.nodes[key]
 	return uint32(len(val)), ok
 }
 
 // GetCapacity gets the capacity reserved for the set of values for the given key
-func (m *memMap) GetCapacity(key uint64) (uint32, bool) {
+func (m *memState) GetCapacity(key uint64) (uint32, bool) {
+	if m.lazy {
+		caplen, _, ok := m.block(key)
+		return blockCap(caplen), ok
+	}
 	val, ok := m.nodes[key]
 	v2, _ := m.extras[key]
 	return uint32(len(val) + (len(v2) / 8)), ok
 }
+
+// acquire returns the current state with a reference held for the caller, or
+// nil if the map is closed. The reference must be released when done.
+func (m *memMap) acquire() *memState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil
+	}
+	atomic.AddInt32(&m.state.refs, 1)
+	return m.state
+}
+
+// publish makes s the current state, and releases the previous one.
+func (m *memMap) publish(s *memState) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		s.release()
+		return ErrClosed
+	}
+	old := m.state
+	m.state = s
+	atomic.AddInt32(&old.region.refs, 1)
+	m.retired = append(m.retired, old.region)
+	m.mu.Unlock()
+	old.release()
+	return nil
+}
+
+// release drops a reference to the state, and to its region when the state
+// is no longer in use.
+func (m *memState) release() error {
+	if atomic.AddInt32(&m.refs, -1) != 0 {
+		return nil
+	}
+	m.nodes = nil
+	m.extras = nil
+	m.bitmaps = nil
+	m.offsets = nil
+	m.table = tableReader{}
+	m.mmap = nil
+	return m.region.release()
+}
+
+// Get returns a slice of values for the given key.
+func (m *memMap) Get(key uint64) ([]uint64, bool) {
+	s := m.acquire()
+	if s == nil {
+		return nil, false
+	}
+	defer s.release()
+	return s.Get(key)
+}
+
+// GetSet returns a set of values for the given key.
+func (m *memMap) GetSet(key uint64) (map[uint64]struct{}, bool) {
+	s := m.acquire()
+	if s == nil {
+		return nil, false
+	}
+	defer s.release()
+	return s.GetSet(key)
+}
+
+// GetWithExtra returns a slice of values for the given key, and calls the "extra" func
+// for any additional data stored within the lookup table.
+func (m *memMap) GetWithExtra(key uint64, extra func(n int, r io.Reader)) ([]uint64, bool) {
+	s := m.acquire()
+	if s == nil {
+		return nil, false
+	}
+	defer s.release()
+	return s.GetWithExtra(key, extra)
+}
+
+// GetBitmap returns the set of values for the given key if it is stored as a
+// bitmap container.
+func (m *memMap) GetBitmap(key uint64) (Bitmap, bool) {
+	s := m.acquire()
+	if s == nil {
+		return Bitmap{}, false
+	}
+	defer s.release()
+	return s.GetBitmap(key)
+}
+
+// GetSize gets the size of the set of values for the given key
+func (m *memMap) GetSize(key uint64) (uint32, bool) {
+	s := m.acquire()
+	if s == nil {
+		return 0, false
+	}
+	defer s.release()
+	return s.GetSize(key)
+}
+
+// GetCapacity gets the capacity reserved for the set of values for the given key
+func (m *memMap) GetCapacity(key uint64) (uint32, bool) {
+	s := m.acquire()
+	if s == nil {
+		return 0, false
+	}
+	defer s.release()
+	return s.GetCapacity(key)
+}
+
+// EachKey calls eachFunc for every key in the map until a non-nil error is returned.
+func (m *memMap) EachKey(eachFunc func(uint64) error) error {
+	s := m.acquire()
+	if s == nil {
+		return ErrClosed
+	}
+	defer s.release()
+	return s.EachKey(eachFunc)
+}
+
+// EachKeySorted calls eachFunc for every key in the map in ascending order
+// until a non-nil error is returned.
+func (m *memMap) EachKeySorted(eachFunc func(uint64) error) error {
+	s := m.acquire()
+	if s == nil {
+		return ErrClosed
+	}
+	defer s.release()
+	return s.EachKeySorted(eachFunc)
+}
+
+// EachKeyReverse calls eachFunc for every key in the map in descending order
+// until a non-nil error is returned.
+func (m *memMap) EachKeyReverse(eachFunc func(uint64) error) error {
+	s := m.acquire()
+	if s == nil {
+		return ErrClosed
+	}
+	defer s.release()
+	return s.EachKeyReverse(eachFunc)
+}
+
+// EachKeyInRange calls eachFunc in ascending order for every key in the map
+// where lo <= key <= hi, until a non-nil error is returned.
+func (m *memMap) EachKeyInRange(lo, hi uint64, eachFunc func(uint64) error) error {
+	s := m.acquire()
+	if s == nil {
+		return ErrClosed
+	}
+	defer s.release()
+	return s.EachKeyInRange(lo, hi, eachFunc)
+}
+
+// EachEntry calls eachFunc with every key and its set of values in sorted key
+// order until a non-nil error is returned.
+func (m *memMap) EachEntry(eachFunc func(key uint64, vals []uint64) error) error {
+	s := m.acquire()
+	if s == nil {
+		return ErrClosed
+	}
+	defer s.release()
+	return s.EachEntry(eachFunc)
+}
+
+// Close unmaps the backing region once any calls in progress have finished.
+// Any slices previously returned by the map must not be used after Close.
+func (m *memMap) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	s := m.state
+	retired := m.retired
+	m.retired = nil
+	if m.stop != nil {
+		close(m.stop)
+	}
+	m.mu.Unlock()
+	for _, r := range retired {
+		r.release()
+	}
+	return s.release()
+}
@@ -1,8 +1,13 @@
 package eightsetmap
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
 
 func TestMMap(t *testing.T) {
+	// uses the map written by TestFibo
+	defer os.Remove(lockName("fibo_testing.8sm"))
 	m := New("fibo_testing.8sm")
 	mm := MMap(m)
 
@@ -1,100 +1,152 @@
 package eightsetmap
 
 import (
+	"bufio"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
 	"os"
 )
 
-// seekToBackingPosition moves to the position in the backing file for the key
-func (m *stdMap) seekToBackingPosition(key uint64) (int64, bool) {
-	var err error
-	if m.f == nil {
-		m.f, err = os.Open(m.filename)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				log.Println(err)
-			}
-			return 0, false
-		}
+// All reads from the backing file use positional reads (ReadAt) into per-call
+// buffers, so a stdMap may be used by many concurrent readers.
+
+// backingOffset finds the position in the backing file for the key.
+func (s *stdState) backingOffset(key uint64) (*os.File, int64, bool) {
+	f := s.f
+	if f == nil {
+		// nothing written yet
+		return nil, 0, false
+	}
+	if s.index {
+		offs, ok := s.indexOffset(key)
+		return f, offs, ok
 	}
 
-	offs, ok := m.offsets[key>>m.shiftkey]
+	offs, ok := s.offsets[key>>s.shiftkey]
 	if !ok {
-		return 0, false
+		return nil, 0, false
 	}
 
-	if m.shiftkey > 0 {
+	if s.shiftkey > 0 {
 		// jump to the lookup table and find the true offset
-		_, err = m.f.Seek(int64(m.start)+(offs*16), os.SEEK_SET)
-		if err != nil {
-			return 0, false
-		}
-
-		var okey uint64
-		if key == 0 {
-			okey = 1
-		}
-		for okey != key {
-			// uint64 key
-			err = binary.Read(m.f, binary.LittleEndian, &okey)
+		var entry [16]byte
+		pos := int64(s.start) + (offs * 16)
+		for {
+			_, err := f.ReadAt(entry[:], pos)
 			if err != nil {
-				panic(err)
+				if err != io.EOF {
+					log.Println(err)
+				}
+				return nil, 0, false
 			}
+			pos += 16
 
-			if (okey >> m.shiftkey) != (key >> m.shiftkey) {
+			okey := binary.LittleEndian.Uint64(entry[:8])
+			if (okey >> s.shiftkey) != (key >> s.shiftkey) {
 				// key not found
-				return 0, false
+				return nil, 0, false
 			}
-
-			// int64 offset
-			err = binary.Read(m.f, binary.LittleEndian, &offs)
-			if err != nil {
-				panic(err)
+			if okey == key {
+				offs = int64(binary.LittleEndian.Uint64(entry[8:]))
+				break
 			}
 		}
 
 		if offs == 0 {
 			// should not happen, but just in case...
-			return 0, false
+			return nil, 0, false
 		}
 	}
 
-	offs, err = m.f.Seek(offs, os.SEEK_SET)
-	return offs, err == nil
+	return f, offs, true
+}
+
+// table returns a reader for the on-disk lookup table. If nothing has been
+// written yet then the table is empty.
+func (s *stdState) table() tableReader {
+	if s.f == nil {
+		return tableReader{}
+	}
+	return tableReader{r: s.tbl, start: int64(s.start), n: s.nkeys}
+}
+
+// readCaplen reads the 64bit caplen int at offs, upper 32bits capacity, lower
+// 32bits length.
+func readCaplen(f io.ReaderAt, offs int64) (uint64, error) {
+	var buf [8]byte
+	_, err := f.ReadAt(buf[:], offs)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+// readValues reads n uint64 values starting at offs.
+func readValues(f io.ReaderAt, offs int64, n uint32) ([]uint64, error) {
+	buf := make([]byte, int(n)*8)
+	_, err := f.ReadAt(buf, offs)
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]uint64, n)
+	for i := range vals {
+		vals[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+	return vals, nil
+}
+
+// readSet reads the set of values described by caplen at offs from a file
+// with the given flags. It returns the values and the offset just past them,
+// where any extra data begins.
+func readSet(f io.ReaderAt, offs int64, caplen uint64, flags uint64) ([]uint64, int64, error) {
+	l := uint32(caplen)
+	if flags&FlagDeltaVarint == 0 && caplen&bitmapBlock == 0 {
+		vals, err := readValues(f, offs+8, l)
+		return vals, offs + 8 + int64(l)*8, err
+	}
+
+	// the encoded size is unknown, so read the full capacity
+	buf := make([]byte, 8*int64(blockCap(caplen)))
+	_, err := f.ReadAt(buf, offs+8)
+	if err != nil {
+		return nil, 0, err
+	}
+	vals, n, err := decodeValues(nil, buf, caplen, flags)
+	return vals, offs + 8 + int64(n), err
 }
 
 // getFromBacking gets the set of values from the backing file
-func (m *stdMap) getFromBacking(key uint64) ([]uint64, bool) {
-	_, ok := m.seekToBackingPosition(key)
+func (s *stdState) getFromBacking(key uint64) ([]uint64, bool) {
+	f, offs, ok := s.backingOffset(key)
 	if !ok {
 		return nil, false
 	}
 
-	// 64bit int, upper 32bits capacity, lower 32bits length
-	var caplen uint64
-	err := binary.Read(m.f, binary.LittleEndian, &caplen)
+	caplen, err := readCaplen(f, offs)
 	if err != nil {
 		log.Println(err)
 		return nil, false
 	}
+	if !validBlock(s.size, offs, caplen, s.flags) {
+		log.Printf("eightsetmap: %s: invalid value set for key %d", s.filename, key)
+		return nil, false
+	}
 
 	// downcast to get just length
 	l := uint32(caplen)
 	if l == 0 {
 		return []uint64{}, true
 	}
-	vals := make([]uint64, l)
 
-	// NB m.f is open/valid due to seekToBackingPosition
-	err = binary.Read(m.f, binary.LittleEndian, &vals)
+	vals, _, err := readSet(f, offs, caplen, s.flags)
 	if err != nil {
 		log.Println(err)
 		return nil, false
 	}
 
-	m.cache.Add(key, vals)
+	s.cache.Add(key, vals)
 	return vals, true
 }
 
@@ -103,49 +155,85 @@ func (m *stdMap) getFromBacking(key uint64) ([]uint64, bool) {
 // remaining and a reader to read from.
 //
 // Note that this func skips caching the key's value-set.
-func (m *stdMap) getWithExtraFromBacking(key uint64, extra func(n int, r io.Reader)) ([]uint64, bool) {
-	_, ok := m.seekToBackingPosition(key)
+func (s *stdState) getWithExtraFromBacking(key uint64, extra func(n int, r io.Reader)) ([]uint64, bool) {
+	f, offs, ok := s.backingOffset(key)
 	if !ok {
 		return nil, false
 	}
 
-	// 64bit int, upper 32bits capacity, lower 32bits length
-	var caplen uint64
-	err := binary.Read(m.f, binary.LittleEndian, &caplen)
+	caplen, err := readCaplen(f, offs)
 	if err != nil {
 		log.Println(err)
 		return nil, false
 	}
+	if !validBlock(s.size, offs, caplen, s.flags) {
+		log.Printf("eightsetmap: %s: invalid value set for key %d", s.filename, key)
+		return nil, false
+	}
 
 	// shift+downcast to get capacity
-	total := uint32(caplen >> 32)
+	total := blockCap(caplen)
 	if total == 0 {
 		return []uint64{}, true
 	}
-	l := uint32(caplen)
-	vals := make([]uint64, l)
-
-	// NB m.f is open/valid due to seekToBackingPosition
-	err = binary.Read(m.f, binary.LittleEndian, &vals)
+	vals, extraOffs, err := readSet(f, offs, caplen, s.flags)
 	if err != nil {
 		log.Println(err)
 		return nil, false
 	}
 
-	extra(int(total-l), m.f)
+	n := int64(total) - (extraOffs-offs-8)/8
+	extra(int(n), io.NewSectionReader(f, extraOffs, n*8))
 
 	return vals, true
 }
 
+// GetBitmap returns the set of values for the given key if it is stored as a
+// bitmap container.
+func (s *stdState) GetBitmap(key uint64) (Bitmap, bool) {
+	if s.flags&FlagBitmaps == 0 {
+		return Bitmap{}, false
+	}
+	f, offs, ok := s.backingOffset(key)
+	if !ok {
+		return Bitmap{}, false
+	}
+
+	caplen, err := readCaplen(f, offs)
+	if err != nil {
+		log.Println(err)
+		return Bitmap{}, false
+	}
+	if caplen&bitmapBlock == 0 {
+		return Bitmap{}, false
+	}
+	if !validBlock(s.size, offs, caplen, s.flags) {
+		log.Printf("eightsetmap: %s: invalid value set for key %d", s.filename, key)
+		return Bitmap{}, false
+	}
+
+	buf := make([]byte, 8*int64(blockCap(caplen)))
+	_, err = f.ReadAt(buf, offs+8)
+	if err != nil {
+		log.Println(err)
+		return Bitmap{}, false
+	}
+	bm, _, err := decodeBitmap(buf)
+	if err != nil {
+		log.Printf("eightsetmap: %s: key %d: %v", s.filename, key, err)
+		return Bitmap{}, false
+	}
+	return bm, true
+}
+
 // GetSize gets the size of the set of values for the given key
-func (m *stdMap) GetSize(key uint64) (uint32, bool) {
-	_, ok := m.seekToBackingPosition(key)
+func (s *stdState) GetSize(key uint64) (uint32, bool) {
+	f, offs, ok := s.backingOffset(key)
 	if !ok {
 		return 0, false
 	}
 
-	var caplen uint64
-	err := binary.Read(m.f, binary.LittleEndian, &caplen)
+	caplen, err := readCaplen(f, offs)
 	if err != nil {
 		log.Println(err)
 		return 0, false
@@ -156,19 +244,73 @@ func (m *stdMap) GetSize(key uint64) (uint32, bool) {
 }
 
 // GetCapacity gets the capacity reserved for the set of values for the given key
-func (m *stdMap) GetCapacity(key uint64) (uint32, bool) {
-	_, ok := m.seekToBackingPosition(key)
+func (s *stdState) GetCapacity(key uint64) (uint32, bool) {
+	f, offs, ok := s.backingOffset(key)
 	if !ok {
 		return 0, false
 	}
 
-	var caplen uint64
-	err := binary.Read(m.f, binary.LittleEndian, &caplen)
+	caplen, err := readCaplen(f, offs)
 	if err != nil {
 		log.Println(err)
 		return 0, false
 	}
 
 	// shift+downcast to get just capacity
-	return uint32(caplen >> 32), true
+	return blockCap(caplen), true
+}
+
+// EachEntry calls eachFunc with every key and its set of values, reading the
+// backing file sequentially in file order until a non-nil error is returned.
+// Values are not cached, and the vals slice is reused between calls so it
+// must be copied if it is retained after eachFunc returns.
+func (s *stdState) EachEntry(eachFunc func(key uint64, vals []uint64) error) error {
+	t := s.table()
+	if t.n == 0 {
+		return nil
+	}
+
+	var r *bufio.Reader
+	var pos int64
+	var buf []byte
+	var vals []uint64
+	return t.each(0, func(key uint64, offs int64) error {
+		if r == nil || offs < pos {
+			r = bufio.NewReaderSize(io.NewSectionReader(s.f, offs, 1<<62), ScanBufferSize)
+			pos = offs
+		} else if offs > pos {
+			// skip over any unused space between blocks
+			n, err := r.Discard(int(offs - pos))
+			pos += int64(n)
+			if err != nil {
+				return err
+			}
+		}
+
+		var caplen [8]byte
+		_, err := io.ReadFull(r, caplen[:])
+		if err != nil {
+			return err
+		}
+		c := binary.LittleEndian.Uint64(caplen[:])
+		if !validBlock(s.size, offs, c, s.flags) {
+			return fmt.Errorf("eightsetmap: %s: invalid value set for key %d: %w", s.filename, key, ErrCorrupt)
+		}
+		// read the values and any extra space in one go
+		sz := 8 * int(blockCap(c))
+		if cap(buf) < sz {
+			buf = make([]byte, sz)
+		}
+		_, err = io.ReadFull(r, buf[:sz])
+		if err != nil {
+			return err
+		}
+		pos += int64(8 + sz)
+
+		vals, _, err = decodeValues(vals, buf[:sz], c, s.flags)
+		if err != nil {
+			return fmt.Errorf("eightsetmap: %s: key %d: %w", s.filename, key, err)
+		}
+		return eachFunc(key, vals)
+	})
 }
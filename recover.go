@@ -0,0 +1,169 @@
+package eightsetmap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+)
+
+// tempMarker is added to the names of temporary files created next to a map,
+// so that Recover can tell them apart from other files.
+const tempMarker = ".8smtmp-"
+
+// createTemp creates a temporary file next to filename for a commit, build
+// run or spilled table, named filename+".8smtmp-"+kind followed by random
+// digits. The file is exclusively locked until it is closed, so that Recover
+// does not remove it while it is still being written.
+func createTemp(filename, kind string) (*os.File, error) {
+	dir, base := filepath.Split(filename)
+	f, err := ioutil.TempFile(dir, base+tempMarker+kind+"*")
+	if err != nil {
+		return nil, err
+	}
+	err = flock(f, true)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// syncFile flushes f to stable storage, closes it, and syncs its directory so
+// that a newly created file is not lost in a crash.
+func syncFile(f *os.File) error {
+	err := f.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(f.Name()))
+}
+
+// replaceFile atomically replaces filename with the temporary file f, which
+// must be in the same directory. Once it returns, either the old or the new
+// contents will be found at filename after a crash, never a partial file.
+// The temporary file is removed if anything fails.
+func replaceFile(f *os.File, filename string) error {
+	err := f.Sync()
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+// syncDir flushes the directory entries in dir to stable storage.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// directories cannot be opened for syncing, renames are durable
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	cerr := d.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// Recover cleans up after a process that crashed while writing filename. It
+// should be called on startup before any maps for filename are opened.
+//
+// Commits replace the file atomically, but older versions of this package
+// moved the live file to filename+".old" first, so if filename is missing
+// the ".old" file is moved back into place. Otherwise a leftover ".old" file
+// is removed, along with any temporary files from unfinished commits and
+// builds that are no longer being written. An interrupted in-place commit is
+// completed from its journal, or discarded if the journal was incomplete.
+// The map is locked exclusively while recovering.
+func Recover(filename string) error {
+	l := &fileLock{}
+	if anyExists(filename, filename+".old", lockName(filename)) {
+		var err error
+		l, err = lockExclusive(filename)
+		if err != nil {
+			return err
+		}
+	}
+	defer l.unlock()
+
+	_, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		err = os.Rename(filename+".old", filename)
+		if err == nil {
+			err = syncDir(filepath.Dir(filename))
+		}
+	} else if err == nil {
+		err = os.Remove(filename + ".old")
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = replayJournal(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	// see createTemp, spilled tables are named after the temporary map file
+	tempName := regexp.MustCompile("^" + regexp.QuoteMeta(base+tempMarker) + `[a-z]*[0-9]+(` + regexp.QuoteMeta(tempMarker) + `table[0-9]+)?$`)
+	for _, fi := range entries {
+		if fi.IsDir() || !tempName.MatchString(fi.Name()) {
+			continue
+		}
+		err = removeUnlocked(filepath.Join(dir, fi.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// anyExists reports whether any of the named files exist.
+func anyExists(names ...string) bool {
+	for _, name := range names {
+		if _, err := os.Stat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// removeUnlocked removes the temporary file name, unless it is locked by a
+// writer that is still running.
+func removeUnlocked(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ok, err := tryFlock(f)
+	if err != nil || !ok {
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,141 @@
+package eightsetmap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recover_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "recover.8sm")
+
+	m := New(filename)
+	mm := Mutate(m, false)
+	mk := mm.OpenKey(1)
+	mk.Put(42)
+	mk.Sync()
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	// a commit must not leave anything besides the map and its lock file behind
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 || files[1].Name() != "recover.8sm.lock" {
+		t.Fatal("commit left", len(files), "files behind")
+	}
+
+	// crashed after moving the live file away
+	err = os.Rename(filename, filename+".old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"recover.8sm.8smtmp-123", "recover.8sm.8smtmp-run456", "recover.8sm.8smtmp-789.8smtmp-table12",
+		"recover.8sm.keep", "recover.8sm20261016", "recover.8sm.8smtmp-"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte("junk"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a temporary file that is still being written must be left alone
+	busy, err := createTemp(filename, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Recover(filename)
+	if err != nil {
+		t.Fatal("unable to recover", err)
+	}
+	names := func() []string {
+		files, _ := ioutil.ReadDir(dir)
+		var names []string
+		for _, fi := range files {
+			names = append(names, fi.Name())
+		}
+		return names
+	}
+	expected := []string{"recover.8sm", "recover.8sm.8smtmp-", filepath.Base(busy.Name()), "recover.8sm.keep", "recover.8sm.lock", "recover.8sm20261016"}
+	if got := names(); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Fatal("unexpected files after recovery", got)
+	}
+	busy.Close()
+	err = Recover(filename)
+	if err != nil {
+		t.Fatal("unable to recover", err)
+	}
+	if _, err = os.Stat(busy.Name()); !os.IsNotExist(err) {
+		t.Fatal("finished temporary file not removed", err)
+	}
+	vals, ok := New(filename).Get(1)
+	if !ok || len(vals) != 1 || vals[0] != 42 {
+		t.Fatal("map not recovered", vals)
+	}
+
+	// crashed before removing the old file
+	err = ioutil.WriteFile(filename+".old", []byte("stale"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Recover(filename)
+	if err != nil {
+		t.Fatal("unable to recover", err)
+	}
+	if _, err = os.Stat(filename + ".old"); !os.IsNotExist(err) {
+		t.Fatal("old file not removed", err)
+	}
+	if _, ok = New(filename).Get(1); !ok {
+		t.Fatal("map lost after recovery")
+	}
+
+	// nothing to do
+	err = Recover(filepath.Join(dir, "missing.8sm"))
+	if err != nil {
+		t.Fatal("unable to recover a missing map", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "missing.8sm.lock")); !os.IsNotExist(err) {
+		t.Fatal("lock file created for a missing map", err)
+	}
+}
+
+func TestCommitOutputFilename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "input.8sm")
+	output := filepath.Join(dir, "output.8sm")
+	err = ioutil.WriteFile(output, []byte("previous contents"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mm := Mutate(New(filename), false)
+	mm.SetOutputFilename(output)
+	mk := mm.OpenKey(1)
+	mk.Put(42)
+	mk.Sync()
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	// the output is replaced by a new file, not rewritten in place
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		if strings.Contains(fi.Name(), tempMarker) {
+			t.Fatal("temporary file left after commit", fi.Name())
+		}
+	}
+	vals, ok := New(output).Get(1)
+	if !ok || len(vals) != 1 || vals[0] != 42 {
+		t.Fatal("unexpected values in output file", vals)
+	}
+}
@@ -0,0 +1,102 @@
+package eightsetmap
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// WithWatch makes the map check its file for changes every interval, and
+// reload it when the file has been replaced or modified by another process.
+// The watcher is stopped by Close.
+func WithWatch(interval time.Duration) Option {
+	return func(o *options) {
+		o.watch = interval
+	}
+}
+
+// Reload loads the lookup table from the file again, so that commits by
+// other processes become visible. Calls already in progress finish using the
+// previously loaded generation of the file. If the file cannot be loaded then
+// the map is unchanged.
+func (m *stdMap) Reload() error {
+	if m.snapshot {
+		return ErrSnapshot
+	}
+	m.replacing.Lock()
+	defer m.replacing.Unlock()
+	s, err := loadStdState(m.filename, &m.opts)
+	if err != nil {
+		if s != nil {
+			s.release()
+		}
+		return err
+	}
+	return m.publish(s)
+}
+
+// loadedInfo returns the file info of the file when it was loaded, or nil if
+// it did not exist.
+func (m *stdMap) loadedInfo() os.FileInfo {
+	s := m.acquire()
+	if s == nil {
+		return nil
+	}
+	defer s.release()
+	return s.info
+}
+
+// Reload maps the file again, so that commits by other processes become
+// visible. Calls already in progress finish using the previously mapped
+// region, which stays mapped until the map is closed so that slices returned
+// by earlier calls remain valid. If the file cannot be loaded then the map is
+// unchanged.
+func (m *memMap) Reload() error {
+	if m.snapshot {
+		return ErrSnapshot
+	}
+	s, err := mmapFile(m.filename, &m.opts)
+	if err != nil {
+		return err
+	}
+	return m.publish(s)
+}
+
+// loadedInfo returns the file info of the file when it was mapped.
+func (m *memMap) loadedInfo() os.FileInfo {
+	s := m.acquire()
+	if s == nil {
+		return nil
+	}
+	defer s.release()
+	return s.info
+}
+
+// watchFile polls filename every interval until stop is closed, and calls
+// reload when the file differs from the one described by loaded: either it
+// was replaced by a rewrite, or modified by an in-place commit.
+func watchFile(filename string, interval time.Duration, stop <-chan struct{}, loaded func() os.FileInfo, reload func() error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			// the file is missing between a crash and Recover
+			continue
+		}
+		old := loaded()
+		if old != nil && os.SameFile(old, info) && old.Size() == info.Size() && old.ModTime().Equal(info.ModTime()) {
+			continue
+		}
+		err = reload()
+		if err != nil && err != ErrClosed {
+			log.Println(err)
+		}
+	}
+}
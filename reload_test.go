@@ -0,0 +1,169 @@
+package eightsetmap
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	os.Remove("reload_testing.8sm")
+	defer os.Remove("reload_testing.8sm")
+	defer os.Remove(lockName("reload_testing.8sm"))
+
+	writer := Mutate(New("reload_testing.8sm"), false)
+	put := func(key, val uint64) {
+		mk := writer.OpenKey(key)
+		mk.Put(val)
+		mk.Sync()
+		err := writer.Commit(false)
+		if err != nil {
+			t.Fatal("unable to commit changes", err)
+		}
+	}
+	put(1, 10)
+
+	m, err := Open("reload_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to open map", err)
+	}
+	defer m.Close()
+	mm, err := OpenMMap("reload_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to mmap map", err)
+	}
+	defer mm.Close()
+
+	// a call in progress keeps using the old file
+	inflight := m.(*stdMap).acquire()
+	held, _ := mm.Get(1)
+
+	put(2, 20)
+	for _, x := range []Map{m, mm} {
+		if _, ok := x.Get(2); ok {
+			t.Fatal("new key visible before reload")
+		}
+		err = x.Reload()
+		if err != nil {
+			t.Fatal("unable to reload", err)
+		}
+		vals, ok := x.Get(2)
+		if !ok || len(vals) != 1 || vals[0] != 20 {
+			t.Fatal("new key not visible after reload", vals)
+		}
+		if x.Generation() != 2 {
+			t.Fatal("expected generation 2 after reload, got", x.Generation())
+		}
+	}
+
+	// slices returned before a reload stay valid until the map is closed
+	put(3, 30)
+	err = mm.Reload()
+	if err != nil {
+		t.Fatal("unable to reload", err)
+	}
+	if len(held) != 1 || held[0] != 10 {
+		t.Fatal("slice returned before the reload changed", held)
+	}
+
+	if _, ok := inflight.Get(2); ok {
+		t.Fatal("call in progress saw the new file")
+	}
+	if vals, ok := inflight.Get(1); !ok || vals[0] != 10 {
+		t.Fatal("call in progress could not read the old file", vals)
+	}
+	inflight.release()
+	if _, err = inflight.f.Stat(); err == nil {
+		t.Fatal("old file not closed after the last call finished")
+	}
+
+	err = m.Close()
+	if err != nil {
+		t.Fatal("unable to close", err)
+	}
+	if err = m.Reload(); err != ErrClosed {
+		t.Fatal("expected ErrClosed reloading a closed map, got", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	os.Remove("watch_testing.8sm")
+	defer os.Remove("watch_testing.8sm")
+	defer os.Remove(lockName("watch_testing.8sm"))
+
+	writer := Mutate(New("watch_testing.8sm"), false)
+	commit := func(key uint64, packed bool) {
+		mk := writer.OpenKey(key)
+		mk.Put(key)
+		mk.Sync()
+		err := writer.Commit(packed)
+		if err != nil {
+			t.Fatal("unable to commit changes", err)
+		}
+	}
+	commit(1, false)
+
+	m, err := Open("watch_testing.8sm", WithWatch(5*time.Millisecond))
+	if err != nil {
+		t.Fatal("unable to open map", err)
+	}
+	defer m.Close()
+	mm, err := OpenMMap("watch_testing.8sm", WithWatch(5*time.Millisecond))
+	if err != nil {
+		t.Fatal("unable to mmap map", err)
+	}
+	defer mm.Close()
+
+	waitFor := func(msg string, key, val uint64, maps ...Map) {
+		deadline := time.Now().Add(5 * time.Second)
+		for _, x := range maps {
+			for {
+				if vals, ok := x.Get(key); ok && len(vals) == 1 && vals[0] == val {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal(msg, "change not picked up by watcher")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	// replaced by a rewrite
+	commit(2, false)
+	waitFor("rewrite:", 2, 2, m, mm)
+
+	// modified by an in-place commit, which is not used while the file is
+	// mapped in this process
+	mm.Close()
+	mk := writer.OpenKey(1)
+	mk.Clear()
+	mk.Put(3)
+	mk.Sync()
+	res, err := writer.CommitWithResult(false)
+	if err != nil || !res.InPlace {
+		t.Fatal("expected an in-place commit", err, res)
+	}
+	waitFor("in-place:", 1, 3, m)
+	// values are read from the same file, so wait for the reload as well
+	for deadline := time.Now().Add(5 * time.Second); m.Generation() != writer.Map.Generation(); {
+		if time.Now().After(deadline) {
+			t.Fatal("in-place commit not reloaded by watcher")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// commits through a watched map race with its reloads
+	own := Mutate(m, false)
+	for k := uint64(10); k < 30; k++ {
+		future := time.Now().Add(time.Duration(k) * time.Second)
+		os.Chtimes("watch_testing.8sm", future, future)
+		mk := own.OpenKey(k)
+		mk.Put(k)
+		mk.Sync()
+		err = own.Commit(true)
+		if err != nil {
+			t.Fatal("unable to commit to a watched map", err)
+		}
+	}
+}
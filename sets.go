@@ -6,7 +6,12 @@ import "sort"
 //
 // NB this implementation is not fully optimized yet
 func MultiUnion(m Map, keys ...uint64) []uint64 {
-	vv := getSets(m, keys)
+	var vv [][]uint64
+	if bm, ok := m.(BitmapMap); ok {
+		vv = getUnionSets(bm, keys)
+	} else {
+		vv = getSets(m, keys)
+	}
 	if len(vv) == 0 {
 		return []uint64{}
 	}
@@ -30,6 +35,9 @@ func MultiIntersect(m Map, keys ...uint64) []uint64 {
 	if len(keys) == 0 {
 		return []uint64{}
 	}
+	if bm, ok := m.(BitmapMap); ok {
+		return bitmapIntersect(bm, keys)
+	}
 	vv := getSets(m, keys)
 	if len(vv) != len(keys) {
 		return []uint64{}
@@ -52,6 +60,10 @@ func MultiIntersect(m Map, keys ...uint64) []uint64 {
 
 // Union returns the set of unique values associated to either k1 or k2.
 func Union(m Map, k1, k2 uint64) []uint64 {
+	if b1, b2, ok := getBitmaps(m, k1, k2); ok && canOr(b1, b2) {
+		return b1.Or(b2).Values([]uint64{})
+	}
+
 	v1, ok := m.Get(k1)
 	if !ok {
 		// no k1, just return k2
@@ -70,6 +82,10 @@ func Union(m Map, k1, k2 uint64) []uint64 {
 
 // Intersect returns the set of values associated to both k1 and k2.
 func Intersect(m Map, k1, k2 uint64) []uint64 {
+	if b1, b2, ok := getBitmaps(m, k1, k2); ok {
+		return b1.And(b2).Values([]uint64{})
+	}
+
 	v1, ok := m.Get(k1)
 	if !ok {
 		// no k1, just return empty
@@ -141,6 +157,99 @@ func getSets(m Map, keys []uint64) [][]uint64 {
 	return vv
 }
 
+// getBitmaps returns the sets for k1 and k2 if both are stored as bitmaps.
+func getBitmaps(m Map, k1, k2 uint64) (Bitmap, Bitmap, bool) {
+	bm, ok := m.(BitmapMap)
+	if !ok {
+		return Bitmap{}, Bitmap{}, false
+	}
+	b1, ok := bm.GetBitmap(k1)
+	if !ok {
+		return Bitmap{}, Bitmap{}, false
+	}
+	b2, ok := bm.GetBitmap(k2)
+	return b1, b2, ok
+}
+
+// canOr returns true if the union of two bitmaps does not need much more
+// space than the bitmaps themselves, i.e. they are not far apart.
+func canOr(b1, b2 Bitmap) bool {
+	return b1.span(b2) <= 2*uint64(len(b1.Bits)+len(b2.Bits))
+}
+
+// getUnionSets is getSets with the sets stored as bitmaps OR-ed together first.
+func getUnionSets(m BitmapMap, keys []uint64) [][]uint64 {
+	var acc Bitmap
+	vv := make([][]uint64, 0, len(keys))
+	for _, k := range keys {
+		if b, ok := m.GetBitmap(k); ok {
+			if len(acc.Bits) == 0 || canOr(acc, b) {
+				acc = acc.Or(b)
+			} else {
+				vv = append(vv, b.Values(make([]uint64, 0, b.Len())))
+			}
+			continue
+		}
+		v, ok := m.Get(k)
+		if !ok || len(v) == 0 {
+			continue
+		}
+		vv = append(vv, v)
+	}
+	if len(acc.Bits) > 0 {
+		vv = append(vv, acc.Values(make([]uint64, 0, acc.Len())))
+	}
+	sort.Slice(vv, func(i, j int) bool { return len(vv[i]) < len(vv[j]) })
+	return vv
+}
+
+// bitmapIntersect is MultiIntersect with the sets stored as bitmaps AND-ed
+// together, then used to filter the intersection of any remaining sets.
+func bitmapIntersect(m BitmapMap, keys []uint64) []uint64 {
+	var acc Bitmap
+	nb := 0
+	vv := make([][]uint64, 0, len(keys))
+	for _, k := range keys {
+		if b, ok := m.GetBitmap(k); ok {
+			if nb == 0 {
+				acc = b
+			} else {
+				acc = acc.And(b)
+			}
+			nb++
+			continue
+		}
+		v, ok := m.Get(k)
+		if !ok || len(v) == 0 {
+			return []uint64{}
+		}
+		vv = append(vv, v)
+	}
+	if len(vv) == 0 {
+		return acc.Values([]uint64{})
+	}
+
+	sort.Slice(vv, func(i, j int) bool { return len(vv[i]) < len(vv[j]) })
+	v3 := vv[0]
+	for _, v2 := range vv[1:] {
+		v3 = subIntersect(v3, v2)
+		if len(v3) == 0 {
+			return []uint64{}
+		}
+	}
+	if nb == 0 {
+		return v3
+	}
+
+	v4 := make([]uint64, 0, len(v3))
+	for _, v := range v3 {
+		if acc.Contains(v) {
+			v4 = append(v4, v)
+		}
+	}
+	return v4
+}
+
 func subUnion(v1, v2 []uint64) []uint64 {
 	v3 := make([]uint64, 0, len(v1)+len(v2))
 	i, j := 0, 0
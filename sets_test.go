@@ -1,6 +1,9 @@
 package eightsetmap
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
 
 func TestSets(t *testing.T) {
 	all := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
@@ -10,6 +13,7 @@ func TestSets(t *testing.T) {
 	efibs := []uint64{2, 8}
 	ofibs := []uint64{1, 3, 5, 13}
 
+	defer os.Remove(lockName("sets_testing.8sm"))
 	m := New("sets_testing.8sm")
 	mm := Mutate(m, false)
 	mk1 := mm.OpenKey(1)
@@ -0,0 +1,219 @@
+package eightsetmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// setWriter streams a new file of sorted keys. The lookup table, checksums and
+// value sets are each written to their own region of the file as keys are
+// added, so only the current key needs to be kept in memory.
+//
+// If the number of keys is not known up front, the lookup table and checksums
+// are spilled to temporary files and written after the value sets by finish.
+type setWriter struct {
+	f      *os.File
+	h      *Header
+	packer PackerFunc
+
+	trailing bool
+	spill    []*os.File // temporary table and checksum files when trailing
+
+	nwritten uint64
+	offs     int64 // offset of the next value set
+
+	table    *bufio.Writer
+	tableCRC hash.Hash32
+	sums     *bufio.Writer
+	data     *bufio.Writer
+
+	buf   []byte
+	extra *bytes.Buffer
+}
+
+// newSetWriter writes the header to f and prepares to write h.NumKeys keys.
+func newSetWriter(f *os.File, h *Header, packer PackerFunc) (*setWriter, error) {
+	h.Flags |= FlagChecksums | FlagGeneration
+	h.TableOffset = h.size()
+	hdr := h.encode()
+	_, err := f.WriteAt(hdr, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	sumStart := h.TableOffset + int64(h.NumKeys)*16
+	w := &setWriter{
+		f:        f,
+		h:        h,
+		packer:   packer,
+		offs:     sumStart + checksumSize(h.NumKeys),
+		tableCRC: crc32.New(castagnoli),
+		extra:    &bytes.Buffer{},
+	}
+	w.table = bufio.NewWriterSize(&offsetWriter{f: f, offs: h.TableOffset}, 1<<20)
+	w.sums = bufio.NewWriterSize(&offsetWriter{f: f, offs: sumStart}, 1<<16)
+	w.data = bufio.NewWriterSize(&offsetWriter{f: f, offs: w.offs}, 50000000) //50mb buffer
+	return w, nil
+}
+
+// newTrailingSetWriter prepares to write any number of keys to f, with the
+// lookup table and checksums placed after the value sets.
+func newTrailingSetWriter(f *os.File, h *Header, packer PackerFunc) (*setWriter, error) {
+	h.Flags |= FlagChecksums | FlagGeneration
+	h.NumKeys = 0
+	h.TableOffset = 0
+	_, err := f.WriteAt(h.encode(), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &setWriter{
+		f:        f,
+		h:        h,
+		packer:   packer,
+		trailing: true,
+		offs:     h.size(),
+		tableCRC: crc32.New(castagnoli),
+		extra:    &bytes.Buffer{},
+	}
+	for i := 0; i < 2; i++ {
+		tf, err := createTemp(f.Name(), "table")
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+		w.spill = append(w.spill, tf)
+	}
+	w.table = bufio.NewWriterSize(w.spill[0], 1<<20)
+	w.sums = bufio.NewWriterSize(w.spill[1], 1<<16)
+	w.data = bufio.NewWriterSize(&offsetWriter{f: f, offs: w.offs}, 50000000) //50mb buffer
+	return w, nil
+}
+
+// close removes any temporary files used by the writer.
+func (w *setWriter) close() {
+	for _, tf := range w.spill {
+		tf.Close()
+		os.Remove(tf.Name())
+	}
+	w.spill = nil
+}
+
+// add writes the lookup table entry and the set of values for key, returning
+// the offset of the value set. Keys must be added in sorted order.
+func (w *setWriter) add(key uint64, vals []uint64) (int64, error) {
+	if !w.trailing && w.nwritten == w.h.NumKeys {
+		return 0, fmt.Errorf("eightsetmap: more keys than expected while writing")
+	}
+	offs := w.offs
+
+	var entry [16]byte
+	binary.LittleEndian.PutUint64(entry[:], key)
+	binary.LittleEndian.PutUint64(entry[8:], uint64(offs))
+	w.tableCRC.Write(entry[:])
+	_, err := w.table.Write(entry[:])
+	if err != nil {
+		return 0, err
+	}
+
+	// caplen placeholder, then the encoded values
+	var bitmap bool
+	w.buf, bitmap = appendSet(append(w.buf[:0], 0, 0, 0, 0, 0, 0, 0, 0), vals, w.h.Flags)
+	words := uint64(len(w.buf)-8) / 8
+
+	extraCount, extraData := w.packer(key, uint32(len(vals)))
+	if extraCount > 0 {
+		w.extra.Reset()
+		err = binary.Write(w.extra, binary.LittleEndian, extraData)
+		if err != nil {
+			return 0, err
+		}
+		if w.extra.Len() != 8*extraCount {
+			return 0, fmt.Errorf("eightsetmap: extra data for key %d is not %d 8-byte chunks", key, extraCount)
+		}
+		w.buf = append(w.buf, w.extra.Bytes()...)
+	}
+	caplen := uint64(len(vals)) | (words+uint64(extraCount))<<32
+	if bitmap {
+		caplen |= bitmapBlock
+	}
+	binary.LittleEndian.PutUint64(w.buf, caplen)
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.Checksum(w.buf, castagnoli))
+	_, err = w.sums.Write(sum[:])
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.data.Write(w.buf)
+	if err != nil {
+		return 0, err
+	}
+
+	w.offs += int64(len(w.buf))
+	w.nwritten++
+	return offs, nil
+}
+
+// finish flushes all buffered data and writes the remaining checksums.
+func (w *setWriter) finish() error {
+	if w.trailing {
+		// the table goes directly after the value sets
+		w.h.NumKeys = w.nwritten
+		w.h.TableOffset = w.offs
+	} else if w.nwritten != w.h.NumKeys {
+		return fmt.Errorf("eightsetmap: wrote %d keys but expected %d", w.nwritten, w.h.NumKeys)
+	}
+
+	var tail [12]byte
+	pad := int(align8(int64(w.nwritten)*4) - int64(w.nwritten)*4)
+	binary.LittleEndian.PutUint32(tail[pad:], w.tableCRC.Sum32())
+	binary.LittleEndian.PutUint32(tail[pad+4:], crc32.Checksum(w.h.encode(), castagnoli))
+	_, err := w.sums.Write(tail[:pad+8])
+	if err != nil {
+		return err
+	}
+
+	for _, bw := range []*bufio.Writer{w.table, w.sums, w.data} {
+		err = bw.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if !w.trailing {
+		return nil
+	}
+	defer w.close()
+
+	// copy the spilled table and checksums, then fill in the header
+	buf := make([]byte, 1<<20)
+	offs := w.h.TableOffset
+	for _, tf := range w.spill {
+		n, err := io.CopyBuffer(&offsetWriter{f: w.f, offs: offs}, io.NewSectionReader(tf, 0, 1<<62), buf)
+		if err != nil {
+			return err
+		}
+		offs += n
+	}
+	_, err = w.f.WriteAt(w.h.encode(), 0)
+	return err
+}
+
+// offsetWriter writes sequentially to a file starting at a given offset, so
+// that multiple regions of the same file can be written at once.
+type offsetWriter struct {
+	f    *os.File
+	offs int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.offs)
+	w.offs += int64(n)
+	return n, err
+}
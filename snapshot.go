@@ -0,0 +1,39 @@
+package eightsetmap
+
+import "sync/atomic"
+
+// Snapshot returns a read-only view of the map pinned to the currently loaded
+// generation of the file. Commits from a MutableMap publish a new generation
+// without disturbing it, and in-place commits are not used while it is open.
+// The snapshot must be closed to release the file.
+func (m *stdMap) Snapshot() (Map, error) {
+	s := m.acquire()
+	if s == nil {
+		return nil, ErrClosed
+	}
+	atomic.AddInt32(&s.snapshots, 1)
+	return &stdMap{
+		filename: m.filename,
+		opts:     m.opts,
+		snapshot: true,
+		state:    s,
+		Data:     s.data,
+	}, nil
+}
+
+// Snapshot returns a read-only view of the map pinned to the currently mapped
+// generation of the file. The mapped region, and any slices returned by the
+// snapshot, remain valid after a Reload until the snapshot is closed, and
+// in-place commits from this process are not used while it is open.
+func (m *memMap) Snapshot() (Map, error) {
+	s := m.acquire()
+	if s == nil {
+		return nil, ErrClosed
+	}
+	return &memMap{
+		filename: m.filename,
+		opts:     m.opts,
+		snapshot: true,
+		state:    s,
+	}, nil
+}
@@ -0,0 +1,233 @@
+package eightsetmap
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	os.Remove("snapshot_testing.8sm")
+	defer os.Remove("snapshot_testing.8sm")
+	defer os.Remove(lockName("snapshot_testing.8sm"))
+
+	m := New("snapshot_testing.8sm")
+	mm := Mutate(m, false)
+	put := func(key, val uint64) *CommitResult {
+		mk := mm.OpenKey(key)
+		mk.Clear()
+		mk.Put(val)
+		mk.Sync()
+		res, err := mm.CommitWithResult(false)
+		if err != nil {
+			t.Fatal("unable to commit changes", err)
+		}
+		return res
+	}
+	put(1, 10)
+	if res := put(1, 11); !res.InPlace {
+		t.Fatal("expected an in-place commit:", res.Reason)
+	}
+
+	snap, err := m.Snapshot()
+	if err != nil {
+		t.Fatal("unable to snapshot", err)
+	}
+	if Mutate(snap, false) != nil {
+		t.Fatal("snapshots must not be mutable")
+	}
+	if err = snap.Reload(); err != ErrSnapshot {
+		t.Fatal("expected ErrSnapshot reloading a snapshot, got", err)
+	}
+
+	// the snapshot forces a rewrite instead of changing the file under it
+	res := put(1, 12)
+	if res.InPlace || res.Reason != "the map is in use by snapshots or other readers" {
+		t.Fatal("expected a rewrite while a snapshot is open:", res.Reason)
+	}
+	put(2, 20)
+	if vals, ok := m.Get(1); !ok || vals[0] != 12 {
+		t.Fatal("map does not see the commit", vals)
+	}
+	if vals, ok := snap.Get(1); !ok || vals[0] != 11 {
+		t.Fatal("snapshot disturbed by the commit", vals)
+	}
+	if _, ok := snap.Get(2); ok {
+		t.Fatal("snapshot sees a key added after it was taken")
+	}
+	if snap.Generation() != 2 || m.Generation() != 4 {
+		t.Fatal("unexpected generations", snap.Generation(), m.Generation())
+	}
+	if changed, err := snap.Changed(); err != nil || !changed {
+		t.Fatal("snapshot should report that the file changed", changed, err)
+	}
+
+	err = snap.Close()
+	if err != nil {
+		t.Fatal("unable to close snapshot", err)
+	}
+	if _, ok := snap.Get(1); ok {
+		t.Fatal("closed snapshot still returns values")
+	}
+	if res = put(1, 13); !res.InPlace {
+		t.Fatal("expected an in-place commit after the snapshot was closed:", res.Reason)
+	}
+
+	// mmap'd snapshots keep their region mapped across reloads
+	x, err := OpenMMap("snapshot_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to mmap map", err)
+	}
+	defer x.Close()
+	xsnap, err := x.Snapshot()
+	if err != nil {
+		t.Fatal("unable to snapshot", err)
+	}
+	held, _ := xsnap.Get(1)
+
+	// writes to the mapped file would change the slices returned from it
+	if res = put(1, 14); res.InPlace || res.Reason != "the file is memory-mapped in this process" {
+		t.Fatal("expected a rewrite while the file is mapped:", res.Reason)
+	}
+	if len(held) != 1 || held[0] != 13 {
+		t.Fatal("slice from snapshot changed by a commit", held)
+	}
+	put(3, 30)
+	err = x.Reload()
+	if err != nil {
+		t.Fatal("unable to reload", err)
+	}
+	if _, ok := x.Get(3); !ok {
+		t.Fatal("reloaded map does not see the commit")
+	}
+	if _, ok := xsnap.Get(3); ok {
+		t.Fatal("snapshot sees a key added after it was taken")
+	}
+	if len(held) != 1 || held[0] != 13 {
+		t.Fatal("slice from snapshot not valid after reload", held)
+	}
+	xsnap.Close()
+	x.Close()
+	if res = put(1, 15); !res.InPlace {
+		t.Fatal("expected an in-place commit after the mapped file was closed:", res.Reason)
+	}
+}
+
+func TestSnapshotConcurrent(t *testing.T) {
+	os.Remove("snapshot_testing2.8sm")
+	defer os.Remove("snapshot_testing2.8sm")
+	defer os.Remove(lockName("snapshot_testing2.8sm"))
+
+	m := New("snapshot_testing2.8sm")
+	mm := Mutate(m, false)
+	commit := func(n uint64) {
+		for k := uint64(0); k < 10; k++ {
+			mk := mm.OpenKey(k)
+			mk.Clear()
+			for i := uint64(0); i < n; i++ {
+				mk.Put(i)
+			}
+			mk.Sync()
+		}
+		err := mm.Commit(false)
+		if err != nil {
+			t.Error("unable to commit changes", err)
+		}
+	}
+	commit(1)
+
+	// every read must see all keys from one generation
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snap, err := m.Snapshot()
+				if err != nil {
+					t.Error("unable to snapshot", err)
+					return
+				}
+				first, _ := snap.GetSize(0)
+				for k := uint64(1); k < 10; k++ {
+					if n, ok := snap.GetSize(k); !ok || n != first {
+						t.Error("snapshot mixes generations", k, n, first)
+					}
+				}
+				snap.Close()
+			}
+		}()
+	}
+	for n := uint64(2); n < 60; n++ {
+		commit(n)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestInplaceWithReaders(t *testing.T) {
+	os.Remove("readers_testing.8sm")
+	defer os.Remove("readers_testing.8sm")
+	defer os.Remove(lockName("readers_testing.8sm"))
+
+	m := New("readers_testing.8sm")
+	mm := Mutate(m, false)
+	for k := uint64(0); k < 10; k++ {
+		mk := mm.OpenKey(k)
+		mk.Put(k)
+		mk.Sync()
+	}
+	err := mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	// in-place commits wait for reads in progress instead of rewriting
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// a slow walk keeps the state in use for a while
+				n := 0
+				m.EachKey(func(k uint64) error {
+					time.Sleep(50 * time.Microsecond)
+					n++
+					return nil
+				})
+				if n != 10 {
+					t.Error("walked", n, "keys instead of 10")
+					return
+				}
+			}
+		}()
+	}
+	for i := uint64(1); i <= 20; i++ {
+		mk := mm.OpenKey(i % 10)
+		mk.Put(100 + i)
+		mk.Sync()
+		res, err := mm.CommitWithResult(false)
+		if err != nil {
+			t.Fatal("unable to commit changes", err)
+		}
+		if !res.InPlace {
+			t.Fatal("expected an in-place commit with readers:", res.Reason)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,180 @@
+package eightsetmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// tableReader reads the sorted [key, offset] lookup table directly from disk
+// (or from a mmap'd region).
+//
+// Entries with a zero offset have been deleted by an in-place commit, and are
+// skipped when walking the table.
+type tableReader struct {
+	r     io.ReaderAt
+	start int64  // offset of the first entry
+	n     uint64 // number of entries
+}
+
+// entry reads the i'th key and offset in the table.
+func (t tableReader) entry(i uint64) (uint64, int64, error) {
+	var buf [16]byte
+	_, err := t.r.ReadAt(buf[:], t.start+int64(i)*16)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrTruncated
+		}
+		return 0, 0, err
+	}
+	return binary.LittleEndian.Uint64(buf[:8]), int64(binary.LittleEndian.Uint64(buf[8:])), nil
+}
+
+// search returns the index of the first entry with a key >= key, or n if
+// there is no such entry.
+func (t tableReader) search(key uint64) (uint64, error) {
+	var err error
+	i := sort.Search(int(t.n), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		k, _, e := t.entry(uint64(i))
+		if e != nil {
+			err = e
+			return true
+		}
+		return k >= key
+	})
+	return uint64(i), err
+}
+
+// each streams the entries from index i to the end of the table, calling fn
+// for each entry until a non-nil error is returned.
+func (t tableReader) each(i uint64, fn func(key uint64, offs int64) error) error {
+	if i >= t.n {
+		return nil
+	}
+	sr := io.NewSectionReader(t.r, t.start+int64(i)*16, int64(t.n-i)*16)
+	r := bufio.NewReaderSize(sr, 1<<16)
+	var entry [16]byte
+	for ; i < t.n; i++ {
+		_, err := io.ReadFull(r, entry[:])
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = ErrTruncated
+			}
+			return err
+		}
+		offs := int64(binary.LittleEndian.Uint64(entry[8:]))
+		if offs == 0 {
+			continue
+		}
+		err = fn(binary.LittleEndian.Uint64(entry[:8]), offs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachReverse walks the entries before index i in reverse order, calling fn
+// for each entry until a non-nil error is returned.
+func (t tableReader) eachReverse(i uint64, fn func(key uint64, offs int64) error) error {
+	if i > t.n {
+		i = t.n
+	}
+	// read a chunk of entries at a time, then walk it backwards
+	const chunk = 4096
+	buf := make([]byte, chunk*16)
+	for i > 0 {
+		c := uint64(chunk)
+		if i < c {
+			c = i
+		}
+		i -= c
+		b := buf[:c*16]
+		_, err := t.r.ReadAt(b, t.start+int64(i)*16)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = ErrTruncated
+			}
+			return err
+		}
+		for j := len(b) - 16; j >= 0; j -= 16 {
+			offs := int64(binary.LittleEndian.Uint64(b[j+8:]))
+			if offs == 0 {
+				continue
+			}
+			err = fn(binary.LittleEndian.Uint64(b[j:]), offs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// eachInRange walks the entries with lo <= key <= hi in sorted order.
+func (t tableReader) eachInRange(lo, hi uint64, fn func(key uint64, offs int64) error) error {
+	if lo > hi {
+		return nil
+	}
+	i, err := t.search(lo)
+	if err != nil {
+		return err
+	}
+	err = t.each(i, func(key uint64, offs int64) error {
+		if key > hi {
+			return errStopIteration
+		}
+		return fn(key, offs)
+	})
+	if err == errStopIteration {
+		return nil
+	}
+	return err
+}
+
+// eachKeyIn calls fn for the keys in sorted keys where lo <= key <= hi, in
+// ascending order or in descending order if reverse, until a non-nil error is
+// returned. It is used to walk legacy lookup tables which are not sorted.
+func eachKeyIn(keys []uint64, lo, hi uint64, reverse bool, fn func(uint64) error) error {
+	if lo > hi {
+		return nil
+	}
+	i := sort.Search(len(keys), func(i int) bool { return keys[i] >= lo })
+	j := sort.Search(len(keys), func(i int) bool { return keys[i] > hi })
+	keys = keys[i:j]
+	for n := range keys {
+		k := keys[n]
+		if reverse {
+			k = keys[len(keys)-1-n]
+		}
+		err := fn(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns every key in ascending order.
+func (s *stdState) sortedKeys() []uint64 {
+	keys := make([]uint64, 0, len(s.offsets))
+	for k := range s.offsets {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// sortedKeys returns every key in ascending order.
+func (m *memState) sortedKeys() []uint64 {
+	keys := make([]uint64, 0, len(m.nodes))
+	for k := range m.nodes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
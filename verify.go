@@ -0,0 +1,219 @@
+package eightsetmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// MaxReportProblems is the maximum number of problems described in a Report.
+var MaxReportProblems = 100
+
+// Report describes the results of Verify.
+type Report struct {
+	// Header is the file header.
+	Header *Header
+
+	// Keys is the number of keys found in the lookup table.
+	Keys uint64
+
+	// Deleted is the number of lookup table entries deleted in-place.
+	Deleted uint64
+
+	// Checksums is true if the file contains checksums that were verified.
+	Checksums bool
+
+	// Problems describes the first MaxReportProblems problems found.
+	Problems []string
+
+	// NumProblems is the total number of problems found.
+	NumProblems int
+}
+
+// OK returns true if no problems were found.
+func (r *Report) OK() bool {
+	return r.NumProblems == 0
+}
+
+func (r *Report) problem(format string, args ...interface{}) {
+	r.NumProblems++
+	if len(r.Problems) < MaxReportProblems {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// Verify checks the integrity of filename: the header, that the lookup table
+// is sorted and all offsets are within the file, that each set of values is
+// sorted and unique and fits within its capacity, and any checksums.
+//
+// If any problems are found then the Report describes them and an error
+// wrapping ErrCorrupt is returned. Files that cannot be read at all return
+// the same errors as Open.
+func Verify(filename string) (*Report, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("eightsetmap: %s: %w", filename, ErrNotExist)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	h, err := readHeader(f)
+	if err != nil {
+		return nil, loadError(filename, err)
+	}
+	r := &Report{
+		Header:    h,
+		Checksums: h.Flags&FlagChecksums != 0,
+	}
+
+	sumStart := h.TableOffset + int64(h.NumKeys)*16
+	tableEnd := sumStart
+	if r.Checksums {
+		tableEnd += checksumSize(h.NumKeys)
+	}
+	if h.TableOffset < h.size() && h.Version > 1 {
+		r.problem("lookup table offset %d overlaps the header", h.TableOffset)
+	}
+	if tableEnd > size {
+		r.problem("lookup table ends at %d, after the end of file at %d", tableEnd, size)
+		return r, fmt.Errorf("eightsetmap: %s: %w", filename, ErrTruncated)
+	}
+
+	// value sets follow the lookup table, unless it was written after them
+	dataStart, dataEnd := tableEnd, size
+	if h.Version > 1 && h.TableOffset > h.size() {
+		dataStart, dataEnd = h.size(), h.TableOffset
+	}
+
+	var sums *bufio.Reader
+	if r.Checksums {
+		err = r.verifyHeaderAndTable(f, h, sumStart)
+		if err != nil {
+			return r, err
+		}
+		sums = bufio.NewReaderSize(io.NewSectionReader(f, sumStart, int64(h.NumKeys)*4), 1<<16)
+	}
+
+	table := bufio.NewReaderSize(io.NewSectionReader(f, h.TableOffset, int64(h.NumKeys)*16), 1<<16)
+	var entry [16]byte
+	var sum [4]byte
+	var lastkey uint64
+	var buf []byte
+	var vals []uint64
+	for i := uint64(0); i < h.NumKeys; i++ {
+		_, err = io.ReadFull(table, entry[:])
+		if err != nil {
+			return r, err
+		}
+		if sums != nil {
+			_, err = io.ReadFull(sums, sum[:])
+			if err != nil {
+				return r, err
+			}
+		}
+		key := binary.LittleEndian.Uint64(entry[:])
+		offs := int64(binary.LittleEndian.Uint64(entry[8:]))
+		if i > 0 && key <= lastkey {
+			r.problem("key %d at table index %d is not sorted after key %d", key, i, lastkey)
+		}
+		lastkey = key
+
+		if offs == 0 {
+			r.Deleted++
+			continue
+		}
+		r.Keys++
+
+		if offs < dataStart || offs+8 > dataEnd {
+			r.problem("key %d has offset %d outside of the data section", key, offs)
+			continue
+		}
+		caplen, err := readCaplen(f, offs)
+		if err != nil {
+			return r, err
+		}
+		if h.Flags&FlagDeltaVarint == 0 && caplen&bitmapBlock == 0 && uint32(caplen) > blockCap(caplen) {
+			r.problem("key %d has length %d > capacity %d", key, uint32(caplen), blockCap(caplen))
+			continue
+		}
+		if !validBlock(dataEnd, offs, caplen, h.Flags) {
+			r.problem("key %d has capacity %d extending past the end of the data section", key, blockCap(caplen))
+			continue
+		}
+
+		n := 8 + 8*int(blockCap(caplen))
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		_, err = f.ReadAt(buf, offs)
+		if err != nil {
+			return r, err
+		}
+		if sums != nil {
+			if crc32.Checksum(buf, castagnoli) != binary.LittleEndian.Uint32(sum[:]) {
+				r.problem("key %d has an invalid checksum", key)
+			}
+		}
+
+		vals, _, err = decodeValues(vals, buf[8:], caplen, h.Flags)
+		if err != nil {
+			r.problem("key %d has an undecodable value set: %v", key, err)
+			continue
+		}
+		var last uint64
+		for j, v := range vals {
+			if j > 0 && v <= last {
+				r.problem("key %d has value %d not sorted and unique after %d", key, v, last)
+				break
+			}
+			last = v
+		}
+	}
+
+	if r.NumProblems > 0 {
+		return r, fmt.Errorf("eightsetmap: %s: %d problems found: %w", filename, r.NumProblems, ErrCorrupt)
+	}
+	return r, nil
+}
+
+// verifyHeaderAndTable checks the header and lookup table checksums.
+func (r *Report) verifyHeaderAndTable(f *os.File, h *Header, sumStart int64) error {
+	tailOffs := sumStart + align8(int64(h.NumKeys)*4)
+	tableSum, err := readChecksum(f, tailOffs)
+	if err != nil {
+		return err
+	}
+	headerSum, err := readChecksum(f, tailOffs+4)
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, h.size())
+	_, err = f.ReadAt(hdr, 0)
+	if err != nil {
+		return err
+	}
+	if crc32.Checksum(hdr, castagnoli) != headerSum {
+		r.problem("header has an invalid checksum")
+	}
+
+	sum, err := tableChecksum(f, h.TableOffset, h.NumKeys)
+	if err != nil {
+		return err
+	}
+	if sum != tableSum {
+		r.problem("lookup table has an invalid checksum")
+	}
+	return nil
+}
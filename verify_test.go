@@ -0,0 +1,101 @@
+package eightsetmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	os.Remove("verify_testing.8sm")
+	m := New("verify_testing.8sm")
+	mm := Mutate(m, false)
+	for k := uint64(1); k <= 50; k++ {
+		mk := mm.OpenKey(k)
+		for i := uint64(0); i < k; i++ {
+			mk.Put(i)
+		}
+		mk.Sync()
+	}
+	err := mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+
+	r, err := Verify("verify_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to verify file", err, r.Problems)
+	}
+	if !r.OK() || !r.Checksums || r.Keys != 50 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	// in-place updates and deletes keep the checksums valid
+	mm = Mutate(m, false)
+	mk := mm.OpenKey(10)
+	mk.Put(100)
+	mk.Sync()
+	mm.DeleteKey(20)
+	err = mm.Commit(false)
+	if err != nil {
+		t.Fatal("unable to commit changes", err)
+	}
+	r, err = Verify("verify_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to verify file after in-place commit", err, r.Problems)
+	}
+	if r.Keys != 49 || r.Deleted != 1 {
+		t.Fatalf("unexpected report after in-place commit %+v", r)
+	}
+
+	orig, err := ioutil.ReadFile("verify_testing.8sm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offs := m.(*stdMap).state.offsets[30]
+
+	// flip a bit in a value
+	data := append([]byte{}, orig...)
+	data[offs+8+8*5] ^= 1
+	err = ioutil.WriteFile("verify_testing.8sm", data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = Verify("verify_testing.8sm")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatal("expected ErrCorrupt after flipping a bit, got", err)
+	}
+	if r.OK() || len(r.Problems) == 0 {
+		t.Fatal("expected problems after flipping a bit")
+	}
+
+	// a huge capacity must not be trusted
+	data = append([]byte{}, orig...)
+	binary.LittleEndian.PutUint64(data[offs:], uint64(1<<31)<<32|30)
+	err = ioutil.WriteFile("verify_testing.8sm", data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Verify("verify_testing.8sm")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatal("expected ErrCorrupt after changing a capacity, got", err)
+	}
+	if _, ok := New("verify_testing.8sm").Get(30); ok {
+		t.Fatal("should not have found key with invalid capacity")
+	}
+
+	// legacy files have no checksums but can still be verified
+	writeLegacy(t, "verify_testing.8sm", nil, []uint64{1, 2, 3})
+	r, err = Verify("verify_testing.8sm")
+	if err != nil {
+		t.Fatal("unable to verify legacy file", err)
+	}
+	if r.Checksums || r.Keys != 3 {
+		t.Fatalf("unexpected report for legacy file %+v", r)
+	}
+
+	os.Remove("verify_testing.8sm")
+	os.Remove(lockName("verify_testing.8sm"))
+}
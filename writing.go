@@ -1,15 +1,11 @@
 package eightsetmap
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
 	"sort"
 	"time"
 )
@@ -22,24 +18,35 @@ var (
 	// e.g. if FillFactor out of DefaultCapacity slots are used in the last bucket,
 	// add more capacity.
 	FillFactor uint32 = 24
+
+	// InplaceWait is how long an in-place commit waits for reads in progress
+	// to finish before rewriting the file instead. New reads wait meanwhile.
+	InplaceWait = 100 * time.Millisecond
 )
 
 // Mutate creates a mutable reference to the map. To write any changes to disk,
 // you must call Commit first. Mutated keys will not be visible to the parent
-// Map until after a reload.
+// Map until they are committed.
 //
 // If autosync is true, then mutated keys are automatically Sync()ed when
 // Commit is called. If false, then you must Sync() mutated keys manually to
 // pull them into a Commit.
 func Mutate(m Map, autosync bool) *MutableMap {
 	sm, ok := m.(*stdMap)
-	if !ok {
+	if !ok || sm.snapshot {
 		log.Println("cannot mutate this map")
 		return nil
 	}
+	var flags uint64
+	if s := sm.acquire(); s != nil {
+		flags = s.flags & knownFlags
+		s.release()
+	}
 	return &MutableMap{
-		Map:   sm,
-		dirty: make(map[uint64][]uint64),
+		Map:     sm,
+		flags:   flags,
+		dirty:   make(map[uint64][]uint64),
+		deleted: make(map[uint64]struct{}),
 
 		mutkeys:  make(map[uint64]*MutableKey),
 		autosync: autosync,
@@ -52,12 +59,37 @@ func (m *MutableMap) SetOutputFilename(fn string) {
 	m.newFilename = fn
 }
 
+// SetCompression enables or disables the delta + varint encoding of value sets
+// (see FlagDeltaVarint). Changing the encoding requires a full rewrite on the
+// next Commit, after which the existing encoding is kept by later commits.
+func (m *MutableMap) SetCompression(enabled bool) {
+	if enabled {
+		m.flags |= FlagDeltaVarint
+	} else {
+		m.flags &^= FlagDeltaVarint
+	}
+}
+
+// SetBitmaps enables or disables storing dense sets of values as bitmap
+// containers (see FlagBitmaps). Changing this requires a full rewrite on the
+// next Commit, after which the setting is kept by later commits.
+func (m *MutableMap) SetBitmaps(enabled bool) {
+	if enabled {
+		m.flags |= FlagBitmaps
+	} else {
+		m.flags &^= FlagBitmaps
+	}
+}
+
 // Get returns a slice of values for the given key. If there is a newly
 // written, uncommitted key then it will be returned.
 func (m *MutableMap) Get(key uint64) ([]uint64, bool) {
 	if vals, ok := m.dirty[key]; ok {
 		return vals, true
 	}
+	if _, ok := m.deleted[key]; ok {
+		return nil, false
+	}
 	return m.Map.Get(key)
 }
 
@@ -71,9 +103,25 @@ func (m *MutableMap) GetSet(key uint64) (map[uint64]struct{}, bool) {
 		}
 		return mv, true
 	}
+	if _, ok := m.deleted[key]; ok {
+		return nil, false
+	}
 	return m.Map.GetSet(key)
 }
 
+// DeleteKey removes the key and its set of values from the map. Unlike
+// MutableKey.Clear, the key will not be found at all after the next Commit.
+// Any open MutableKey for the key is emptied and closed, so OpenKey returns a
+// new one, but the old one may still be used: a later Sync adds the key back.
+func (m *MutableMap) DeleteKey(key uint64) {
+	if mk, ok := m.mutkeys[key]; ok {
+		mk.Clear()
+		delete(m.mutkeys, key)
+	}
+	delete(m.dirty, key)
+	m.deleted[key] = struct{}{}
+}
+
 // MutableKey represents a key that is open for writing changes to the set of
 // values. Once open, the calling code must call Sync to add changes to the
 // MutableMap's buffered changes.
@@ -100,8 +148,11 @@ func (m *MutableMap) OpenKey(key uint64) *MutableKey {
 			vals[v] = struct{}{}
 		}
 	} else {
-		vals, ok = m.Map.GetSet(key)
-		if !ok {
+		_, deleted := m.deleted[key]
+		if !deleted {
+			vals, ok = m.Map.GetSet(key)
+		}
+		if deleted || !ok {
 			vals = make(map[uint64]struct{}, DefaultCapacity)
 		}
 	}
@@ -125,6 +176,7 @@ func (k *MutableKey) Sync() {
 	}
 	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
 	k.MutableMap.dirty[k.key] = vals
+	delete(k.MutableMap.deleted, k.key)
 	k.synced = true
 }
 
@@ -190,81 +242,235 @@ func (k *MutableKey) RemoveSlice(vals []uint64) {
 	}
 }
 
-// inplaceCommit tries to put new values into the map without rewriting the
-// whole file. It returns true on success.
-func (m *MutableMap) inplaceCommit() bool {
-	for key, vals := range m.dirty {
-		if _, ok := m.Map.seekToBackingPosition(key); !ok {
-			return false
-		}
+// CommitResult describes how the changes were written by CommitWithResult.
+type CommitResult struct {
+	// InPlace is true if the changes were written into the existing file,
+	// using the space reserved by an earlier commit.
+	InPlace bool
 
-		var caplen uint64
-		err := binary.Read(m.Map.f, binary.LittleEndian, &caplen)
-		if err != nil {
-			log.Println(err)
-			return false
-		}
+	// Reason describes why the changes could not be written in place, when
+	// InPlace is false.
+	Reason string
 
-		c := uint32(caplen >> 32)
-		if c < uint32(len(vals)) {
-			// will not fit without resize
-			return false
-		}
+	// RewriteKeys lists the keys in ascending order which forced a full
+	// rewrite, because they were new or their sets outgrew their capacity.
+	RewriteKeys []uint64
+
+	// BytesWritten is the number of bytes written to the map file.
+	BytesWritten int64
+}
+
+// inplaceCommit tries to put new values into the map without rewriting the
+// whole file. Every change is checked before anything is written, and if a
+// full rewrite is needed then res describes why and no changes are made.
+// An error means the changes were journaled but could not be applied, they
+// will be replayed when the map is next opened.
+func (m *MutableMap) inplaceCommit(res *CommitResult) error {
+	s := m.Map.acquire()
+	if s == nil {
+		return ErrClosed
+	}
+	defer s.release()
+	if m.flags&FlagsRequired != s.flags&FlagsRequired {
+		res.Reason = "the encoding of value sets changed"
+		return nil
 	}
-	// passed checks, we can update in-place!
-	m.Map.f.Close()
-	m.Map.f = nil
 
-	f, err := os.OpenFile(m.Map.filename, os.O_RDWR, 0644)
+	// readers in other processes must not load the file while it is modified
+	l, err := lockExclusive(m.Map.filename)
 	if err != nil {
-		return false
+		res.Reason = err.Error()
+		return nil
 	}
-	m.Map.f = f
-	defer func() {
-		m.Map.f.Close()
-		m.Map.f = nil
-	}()
+	defer l.unlock()
 
+	offsets := make(map[uint64]int64, len(m.dirty))
+	blocks := make(map[uint64][]byte, len(m.dirty))
+	var newKeys, fullKeys int
 	for key, vals := range m.dirty {
-		if _, ok := m.Map.seekToBackingPosition(key); !ok {
-			return false
+		f, offs, ok := s.backingOffset(key)
+		if !ok {
+			newKeys++
+			res.RewriteKeys = append(res.RewriteKeys, key)
+			continue
 		}
 
-		var caplen uint64
-		err := binary.Read(m.Map.f, binary.LittleEndian, &caplen)
+		caplen, err := readCaplen(f, offs)
 		if err != nil {
-			log.Println(err)
-			return false
+			res.Reason = err.Error()
+			return nil
 		}
 
-		c := uint32(caplen >> 32)
-		l := uint32(caplen)
-		if l != uint32(len(vals)) {
-			_, err = m.Map.f.Seek(-8, os.SEEK_CUR)
-			if err != nil {
-				log.Println(err)
-				return false
+		if !validBlock(s.size, offs, caplen, s.flags) {
+			res.Reason = fmt.Sprintf("invalid value set for key %d", key)
+			return nil
+		}
+		c := blockCap(caplen)
+		buf, bitmap := appendSet(make([]byte, 8, 8+8*len(vals)), vals, s.flags)
+		if uint64(c)*8 < uint64(len(buf)-8) {
+			// will not fit without resize
+			fullKeys++
+			res.RewriteKeys = append(res.RewriteKeys, key)
+			continue
+		}
+		caplen = uint64(c)<<32 | uint64(len(vals))
+		if bitmap {
+			caplen |= bitmapBlock
+		}
+		binary.LittleEndian.PutUint64(buf, caplen)
+		offsets[key] = offs
+		blocks[key] = buf
+	}
+	if len(res.RewriteKeys) > 0 {
+		sort.Slice(res.RewriteKeys, func(i, j int) bool { return res.RewriteKeys[i] < res.RewriteKeys[j] })
+		res.Reason = fmt.Sprintf("%d new keys and %d sets over capacity", newKeys, fullKeys)
+		return nil
+	}
+
+	// deleted keys are removed by zeroing their offset in the lookup table
+	tombstones := make(map[uint64]int64, len(m.deleted))
+	if len(m.deleted) > 0 {
+		t := s.table()
+		for key := range m.deleted {
+			if !s.hasKey(key) {
+				// not on disk, nothing to do
+				continue
+			}
+			if s.version < 2 {
+				// older readers would treat a zero offset as a set at the
+				// start of the file, so the file must be upgraded instead
+				res.Reason = "deleting keys from a legacy file"
+				return nil
 			}
-			caplen = uint64(c)<<32 | uint64(len(vals))
-			err := binary.Write(m.Map.f, binary.LittleEndian, caplen)
+			i, err := t.search(key)
 			if err != nil {
-				log.Println(err)
-				return false
+				res.Reason = err.Error()
+				return nil
+			}
+			if k, _, err := t.entry(i); err != nil || k != key {
+				res.Reason = fmt.Sprintf("deleted key %d not found in lookup table", key)
+				return nil
 			}
+			tombstones[key] = t.start + int64(i)*16 + 8
 		}
+	}
+
+	// the offsets are only valid for the file that was loaded
+	info, err := os.Stat(m.Map.filename)
+	if err != nil || s.info == nil || !os.SameFile(info, s.info) {
+		res.Reason = "the file was replaced since the map was loaded"
+		return nil
+	}
+	// files are mapped while the exclusive lock is not held, so this cannot
+	// change until the writes are done
+	if isMapped(info) {
+		res.Reason = "the file is memory-mapped in this process"
+		return nil
+	}
+
+	// passed checks, we can update in-place! all writes are journaled first
+	// so that they are applied all-or-nothing.
+	j := &journal{r: s.f}
 
-		err = binary.Write(m.Map.f, binary.LittleEndian, vals)
+	for key, buf := range blocks {
+		j.WriteAt(buf, offsets[key])
+	}
+	var zero [8]byte
+	for _, pos := range tombstones {
+		j.WriteAt(zero[:], pos)
+	}
+	gen := s.gen
+	if s.flags&FlagGeneration != 0 && len(j.writes) > 0 {
+		gen++
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], gen)
+		j.WriteAt(buf[:], generationOffset)
+	}
+
+	if s.flags&FlagChecksums != 0 {
+		err = s.updateChecksums(j, offsets, len(tombstones) > 0, gen != s.gen)
 		if err != nil {
-			log.Println(err)
-			return false
+			res.Reason = err.Error()
+			return nil
 		}
 	}
+
+	// the writes would be seen by any reads in progress and snapshots of the
+	// loaded file, so no new reads may start until they have been applied
+	m.Map.mu.Lock()
+	defer m.Map.mu.Unlock()
+	if m.Map.state != s || !s.drain(InplaceWait) {
+		res.Reason = "the map is in use by snapshots or other readers"
+		return nil
+	}
+
+	applied := true
+	if len(j.writes) > 0 {
+		applied, err = j.commit(m.Map.filename)
+	}
+	if !applied {
+		res.Reason = err.Error()
+		return nil
+	}
+	if err != nil {
+		// the journal will be replayed when the map is next opened
+		return err
+	}
+	res.InPlace = true
+	for _, w := range j.writes {
+		res.BytesWritten += int64(len(w.data))
+	}
+	s.gen = gen
+	s.info, _ = s.f.Stat()
+
 	// if we got here without failing then all was ok!
 	for key, vals := range m.dirty {
-		m.Map.cache.Add(key, vals)
+		s.cache.Add(key, vals)
 		delete(m.dirty, key)
 	}
-	return true
+	for key := range m.deleted {
+		if _, ok := tombstones[key]; ok {
+			s.ndeleted++
+			if s.shiftkey == 0 {
+				delete(s.offsets, key)
+			}
+		}
+		s.cache.Remove(key)
+		delete(m.deleted, key)
+	}
+	return nil
+}
+
+// checkUnchanged returns ErrStale if filename is no longer the file that s was
+// loaded from, or it has been committed to in-place by another process. The
+// exclusive lock must be held.
+func (s *stdState) checkUnchanged(filename string) error {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) && s.info == nil {
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	stale := fmt.Errorf("eightsetmap: %s: %w", filename, ErrStale)
+	if info == nil || s.info == nil || !os.SameFile(info, s.info) {
+		return stale
+	}
+	if s.flags&FlagGeneration == 0 {
+		// without a generation counter, in-place commits change the mtime
+		if info.Size() != s.info.Size() || !info.ModTime().Equal(s.info.ModTime()) {
+			return stale
+		}
+		return nil
+	}
+	h, err := ReadHeader(filename)
+	if err != nil {
+		return err
+	}
+	if h.Generation != s.gen {
+		return stale
+	}
+	return nil
 }
 
 // PackerFunc is a function that tells the serialization code how to pack additional
@@ -299,32 +505,56 @@ func DefaultPacker(key uint64, valsize uint32) (count int, extra interface{}) {
 //
 // If packed is false, then a much faster in-place commit is possible (using the additional
 // space reserved from the previous un-packed commit). If an in-place commit is not possible
-// then a standard full commit will be used.
+// then a standard full commit will be used. A full commit returns ErrStale if
+// another writer committed to the file since the map was loaded.
 //
 // Note if autosync is enabled and there are no changes, nothing will be done.
 func (m *MutableMap) Commit(packed bool) error {
-	if m.autosync {
-		for k, mk := range m.mutkeys {
-			if !mk.synced {
-				mk.Sync()
-			}
-			delete(m.mutkeys, k)
-		}
-		if len(m.dirty) == 0 {
-			// nothing to write!
-			return nil
-		}
+	_, err := m.CommitWithResult(packed)
+	return err
+}
+
+// CommitWithResult is the same as Commit, but also describes how the changes
+// were written. This can be used to log why in-place commits are not possible,
+// and to tune DefaultCapacity and FillFactor.
+func (m *MutableMap) CommitWithResult(packed bool) (*CommitResult, error) {
+	res := &CommitResult{}
+	if m.autosync && !m.syncKeys() {
+		res.Reason = "no changes"
+		return res, nil
 	}
 
 	if packed {
-		return m.CommitWithPacker(TightPacker)
+		res.Reason = "packed commit requested"
+		return res, m.rewrite(TightPacker, res)
 	}
 
-	if m.inplaceCommit() {
-		return nil
+	err := m.inplaceCommit(res)
+	if res.InPlace || err != nil {
+		return res, err
 	}
 
-	return m.CommitWithPacker(DefaultPacker)
+	return res, m.rewrite(DefaultPacker, res)
+}
+
+// syncKeys syncs any open keys, and returns false if there is nothing to commit.
+func (m *MutableMap) syncKeys() bool {
+	for k, mk := range m.mutkeys {
+		if !mk.synced {
+			mk.Sync()
+		}
+		delete(m.mutkeys, k)
+	}
+	if len(m.dirty) != 0 || len(m.deleted) != 0 {
+		return true
+	}
+	s := m.Map.acquire()
+	if s == nil {
+		// let the commit report ErrClosed
+		return true
+	}
+	defer s.release()
+	return m.flags&FlagsRequired != s.flags&FlagsRequired
 }
 
 // CommitWithPacker allows the usage of custom data embedded into the lookup table. Maps
@@ -332,257 +562,232 @@ func (m *MutableMap) Commit(packed bool) error {
 //
 // Note if autosync is enabled and there are no changes, nothing will be done.
 func (m *MutableMap) CommitWithPacker(packer PackerFunc) error {
-	if m.autosync {
-		for k, mk := range m.mutkeys {
-			if !mk.synced {
-				mk.Sync()
-			}
-			delete(m.mutkeys, k)
-		}
-
-		if len(m.dirty) == 0 {
-			// nothing to write!
-			return nil
-		}
-	}
-
-	if m.Map.f != nil {
-		m.Map.f.Close()
-		m.Map.f = nil
+	if m.autosync && !m.syncKeys() {
+		// nothing to write!
+		return nil
 	}
+	return m.rewrite(packer, &CommitResult{})
+}
 
-	oldf, err := os.Open(m.Map.filename)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return err
-		}
-	}
-	if err == nil {
-		defer oldf.Close()
+// rewrite writes a new file with all of the changes merged in, using packer
+// to reserve space for each set.
+func (m *MutableMap) rewrite(packer PackerFunc, res *CommitResult) error {
+	s := m.Map.acquire()
+	if s == nil {
+		return ErrClosed
 	}
+	defer s.release()
+	oldf := s.f
 
-	var newf *os.File
-	isTemp := true
-	if m.newFilename == "" {
-		dir, base := filepath.Split(m.Map.filename)
-		newf, err = ioutil.TempFile(dir, base)
-	} else {
-		isTemp = false
-		newf, err = os.Create(m.newFilename)
+	// the new file is written next to its destination and moved into place
+	target := m.Map.filename
+	if m.newFilename != "" {
+		target = m.newFilename
 	}
+	newf, err := createTemp(target, "")
 	if err != nil {
 		return err
 	}
-	defer newf.Close()
-
-	// if a shiftkey is in use, we'd have to scan the current file for offsets
-	if m.Map.shiftkey > 0 {
-		return fmt.Errorf("not implemented")
-	}
+	committed := false
+	defer func() {
+		newf.Close()
+		if !committed {
+			os.Remove(newf.Name())
+		}
+	}()
 
-	x := uint32(MAGIC)
-	err = binary.Write(newf, binary.LittleEndian, x)
-	if err != nil {
-		return err
-	}
-	// overflow is possible, but if it happens WTF
-	x = uint32(len(m.Map.Data))
-	err = binary.Write(newf, binary.LittleEndian, x)
+	/////
+	// the old lookup table is streamed from disk and merged with the sorted
+	// dirty keys, so that only the (possibly shifted) offsets are kept in memory.
+	dirtyKeys := make([]uint64, 0, len(m.dirty))
+	totalKeys, err := s.liveKeys()
 	if err != nil {
 		return err
 	}
-	if x != 0 {
-		_, err = newf.Write(m.Map.Data)
-		if err != nil {
-			return err
+	for k := range m.dirty {
+		dirtyKeys = append(dirtyKeys, k)
+		if !s.hasKey(k) {
+			totalKeys++
 		}
 	}
-
-	/////
-	keys := make([]uint64, 0, len(m.Map.offsets)+len(m.dirty))
-	for k := range m.Map.offsets {
-		keys = append(keys, k)
-	}
-	for k := range m.dirty {
-		if _, ok := m.Map.offsets[k]; !ok {
-			keys = append(keys, k)
+	for k := range m.deleted {
+		if s.hasKey(k) {
+			totalKeys--
 		}
 	}
-	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	sort.Slice(dirtyKeys, func(i, j int) bool { return dirtyKeys[i] < dirtyKeys[j] })
+
+	// Data may be replaced by a reload from the watcher
+	m.Map.mu.RLock()
+	data := m.Map.Data
+	m.Map.mu.RUnlock()
 
-	totalKeys := uint64(len(keys))
-	err = binary.Write(newf, binary.LittleEndian, totalKeys)
+	h := &Header{
+		// only carry over the features that are understood
+		Flags:   m.flags,
+		NumKeys: totalKeys,
+		Data:    data,
+
+		Generation: s.gen + 1,
+	}
+	sw, err := newSetWriter(newf, h, packer)
 	if err != nil {
 		return err
 	}
 
-	newoffsets := make(map[uint64]int64, len(keys))
+	// with a disk index the new table is searched on disk as well
+	var newoffsets map[uint64]int64
+	if !s.index {
+		newoffsets = make(map[uint64]int64)
+	}
+	var nwritten int64
 
-	// start writing keys and offsets
-	for _, k := range keys {
-		// write out the key
-		err = binary.Write(newf, binary.LittleEndian, k)
+	// writeKey writes the set of values for k and records its offset.
+	writeKey := func(k uint64, vals []uint64) error {
+		offs, err := sw.add(k, vals)
 		if err != nil {
 			return err
 		}
-		// placeholder for offset
-		err = binary.Write(newf, binary.LittleEndian, k)
-		if err != nil {
-			return err
+		if s.index {
+			// nothing to keep in memory
+		} else if s.shiftkey > 0 {
+			if _, exists := newoffsets[k>>s.shiftkey]; !exists {
+				newoffsets[k>>s.shiftkey] = nwritten
+			}
+		} else {
+			newoffsets[k] = offs
 		}
-
-		newoffsets[k] = 0
+		nwritten++
+		return nil
 	}
 
-	offs, err := newf.Seek(0, os.SEEK_CUR)
-	w := bufio.NewWriterSize(newf, 50000000) //50mb buffer
-
-	////////
-	for _, k := range keys {
-		newoffsets[k] = offs
-
-		var caplen uint64
-		if newvals, ok := m.dirty[k]; ok {
-			caplen = uint64(len(newvals))
-
-			extraCount, extraData := packer(k, uint32(len(newvals)))
-			caplen |= (caplen + uint64(extraCount)) << 32
-
-			err = binary.Write(w, binary.LittleEndian, caplen)
+	di := 0
+	// mergeOld writes the dirty keys that sort before k, then k with either
+	// its new values or its values copied from the old file.
+	mergeOld := func(k uint64, o int64) error {
+		for di < len(dirtyKeys) && dirtyKeys[di] < k {
+			err := writeKey(dirtyKeys[di], m.dirty[dirtyKeys[di]])
 			if err != nil {
 				return err
 			}
-			err = binary.Write(w, binary.LittleEndian, newvals)
-			if err != nil {
-				return err
-			}
-			offs += int64(8 + 8*len(newvals) + 8*extraCount)
-			if extraCount > 0 {
-				err = binary.Write(w, binary.LittleEndian, extraData)
-				if err != nil {
-					return err
-				}
-			}
-
-			continue
+			di++
 		}
-
-		_, err = oldf.Seek(m.Map.offsets[k], os.SEEK_SET)
-		if err != nil {
-			return err
+		if di < len(dirtyKeys) && dirtyKeys[di] == k {
+			di++
+			return writeKey(k, m.dirty[k])
 		}
-
-		err = binary.Read(oldf, binary.LittleEndian, &caplen)
-		if err != nil {
-			return err
+		if _, ok := m.deleted[k]; ok {
+			return nil
 		}
 
-		// shift+downcast to get capacity
-		vals := make([]uint64, uint32(caplen>>32))
-		err = binary.Read(oldf, binary.LittleEndian, &vals)
+		caplen, err := readCaplen(oldf, o)
 		if err != nil {
 			return err
 		}
-
-		// truncate to values only
-		vals = vals[:uint32(caplen)]
-		caplen = uint64(len(vals))
-		extraCount, extraData := packer(k, uint32(len(vals)))
-		caplen |= (caplen + uint64(extraCount)) << 32
-
-		//	copy caplen + values to new file
-		err = binary.Write(w, binary.LittleEndian, caplen)
-		if err != nil {
-			return err
+		if !validBlock(s.size, o, caplen, s.flags) {
+			return fmt.Errorf("eightsetmap: invalid value set for key %d: %w", k, ErrCorrupt)
 		}
-		err = binary.Write(w, binary.LittleEndian, vals)
+		// copy values only
+		vals, _, err := readSet(oldf, o, caplen, s.flags)
 		if err != nil {
 			return err
 		}
-		offs += int64(8 + 8*len(vals) + 8*extraCount)
-		if extraCount > 0 {
-			err = binary.Write(w, binary.LittleEndian, extraData)
+		return writeKey(k, vals)
+	}
+	if oldf != nil && s.unsorted {
+		// legacy tables may not be sorted, but then all offsets are in memory
+		for _, k := range s.sortedKeys() {
+			err = mergeOld(k, s.offsets[k])
 			if err != nil {
 				return err
 			}
 		}
-	}
-
-	// not used anymore after this
-	w.Flush()
-
-	// jump back to the top offset table
-	_, err = newf.Seek(int64(16+len(m.Map.Data)), os.SEEK_SET)
-	if err != nil {
-		return err
-	}
-
-	// now write correct offsets
-	for _, k := range keys {
-		// write out the key (again)
-		err = binary.Write(newf, binary.LittleEndian, k)
+	} else if oldf != nil {
+		var lastkey uint64
+		first := true
+		oldt := tableReader{r: oldf, start: int64(s.start), n: s.nkeys}
+		err = oldt.each(0, func(k uint64, o int64) error {
+			if !first && k <= lastkey {
+				return ErrUnsorted
+			}
+			first = false
+			lastkey = k
+			return mergeOld(k, o)
+		})
 		if err != nil {
 			return err
 		}
-		// now write the real offset
-		err = binary.Write(newf, binary.LittleEndian, newoffsets[k])
+	}
+	for ; di < len(dirtyKeys); di++ {
+		err = writeKey(dirtyKeys[di], m.dirty[dirtyKeys[di]])
 		if err != nil {
 			return err
 		}
 	}
+	err = sw.finish()
+	if err != nil {
+		return err
+	}
 
 	////////
 
-	tmpName := newf.Name()
-	err = newf.Close()
+	var rf *os.File
+	m.Map.replacing.Lock()
+	defer m.Map.replacing.Unlock()
+	l, err := lockExclusive(target)
 	if err != nil {
 		return err
 	}
-
-	if isTemp {
-		if oldf != nil {
-			err = os.Rename(m.Map.filename, m.Map.filename+".old")
-			if err != nil {
-				return err
-			}
-		}
-
-		err = os.Rename(tmpName, m.Map.filename)
-		if err != nil {
-			start := time.Now()
-			var a, b *os.File
-			// i get a cross-device link error when i try to move across partitions
-			// so let's address that
-			a, err = os.Open(tmpName)
-			if err == nil {
-				b, err = os.Create(m.Map.filename)
-				if err == nil {
-					_, err = io.Copy(b, a)
-					b.Close()
-				}
-				a.Close()
-			}
-			elap := time.Now().Sub(start)
-			log.Println("took", elap, "to copy across partitions")
-		}
-		if err != nil {
-			return err
-		}
-		if oldf != nil {
-			err = os.Remove(m.Map.filename + ".old")
-			if err != nil {
-				log.Println(err)
-			}
-		}
+	if target == m.Map.filename {
+		err = s.checkUnchanged(target)
 	}
+	if err == nil {
+		err = replaceFile(newf, target)
+	}
+	if err == nil {
+		// reopen before another process can replace the file again
+		rf, err = os.Open(target)
+	}
+	l.unlock()
+	if err != nil {
+		return err
+	}
+	committed = true
+	res.BytesWritten = sw.offs
 
-	// move new data into m.Map so it can be used immediately,
+	// publish the new file so it can be used immediately,
 	// and clear out dirty list to be reused...
-	m.Map.offsets = newoffsets
+	ns := &stdState{
+		filename: rf.Name(),
+		f:        rf,
+		start:    int(h.TableOffset),
+		nkeys:    totalKeys,
+		flags:    h.Flags,
+		gen:      h.Generation,
+		version:  FormatVersion,
+		size:     sw.offs,
+		data:     h.Data,
+		offsets:  newoffsets,
+		shiftkey: s.shiftkey,
+		index:    s.index,
+		tbl:      rf,
+		cache:    newCache(&m.Map.opts),
+		refs:     1,
+	}
+	ns.info, err = rf.Stat()
+	if err != nil {
+		ns.release()
+		return err
+	}
+	if ns.index {
+		ns.mapTable(rf)
+	}
 	for k, v := range m.dirty {
-		m.Map.cache.Add(k, v)
+		ns.cache.Add(k, v)
 		delete(m.dirty, k)
 	}
-	m.Map.start = 16 + len(m.Map.Data)
-	return nil
+	for k := range m.deleted {
+		delete(m.deleted, k)
+	}
+	return m.Map.publish(ns)
 }